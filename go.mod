@@ -0,0 +1,9 @@
+module proj3
+
+go 1.23.0
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	golang.org/x/image v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
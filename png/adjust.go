@@ -0,0 +1,181 @@
+package png
+
+import (
+	"math"
+)
+
+// pointOp maps one normalized (0..1) RGB pixel to another. Point operations read
+// nothing but the pixel itself, so consecutive ones can share a single pass.
+type pointOp func(r, g, b float64) (float64, float64, float64)
+
+// PointOp returns the per-pixel function of a color adjustment effect, or false if
+// the effect is not a point operation. An effect restricted to some channels or
+// to a mask is not, since it can't share a pass with others.
+func (spec EffectSpec) PointOp() (pointOp, bool) {
+	if spec.restricted() {
+		return nil, false
+	}
+	return spec.pointOp(false)
+}
+
+// pointOp is PointOp for an image that is in linear light if linear is set.
+func (spec EffectSpec) pointOp(linear bool) (pointOp, bool) {
+	switch spec.Name {
+	case "convert":
+		return convert(spec.String("from", "rgb"), spec.String("to", "rgb"), linear), true
+	case "brightness":
+		amount := spec.Float("amount", 0)
+		return func(r, g, b float64) (float64, float64, float64) {
+			return r + amount, g + amount, b + amount
+		}, true
+	case "contrast":
+		amount := spec.Float("amount", 1)
+		f := func(c float64) float64 { return (c-0.5)*amount + 0.5 }
+		return func(r, g, b float64) (float64, float64, float64) {
+			return f(r), f(g), f(b)
+		}, true
+	case "gamma":
+		inv := 1 / spec.Float("gamma", 1)
+		f := func(c float64) float64 { return math.Pow(math.Max(c, 0), inv) }
+		return func(r, g, b float64) (float64, float64, float64) {
+			return f(r), f(g), f(b)
+		}, true
+	case "saturation":
+		amount := spec.Float("amount", 1)
+		return func(r, g, b float64) (float64, float64, float64) {
+			lum := luminance(r, g, b)
+			return lum + amount*(r-lum), lum + amount*(g-lum), lum + amount*(b-lum)
+		}, true
+	case "hue":
+		return hueRotation(spec.Float("degrees", 0)), true
+	case "levels":
+		if spec.Global() {
+			return nil, false
+		}
+		return levels(spec.Float("black", 0), spec.Float("white", 1), spec.Float("gamma", 1)), true
+	case "invert":
+		return func(r, g, b float64) (float64, float64, float64) {
+			return 1 - r, 1 - g, 1 - b
+		}, true
+	}
+	return nil, false
+}
+
+// Global reports whether the effect needs statistics of the whole image before
+// it can map any pixel. See Stats.
+func (spec EffectSpec) Global() bool {
+	switch spec.Name {
+	case "levels":
+		return spec.Params["auto"] == true
+	case "equalize", "clahe":
+		return true
+	}
+	return false
+}
+
+// luminance returns the Rec. 709 luma of a normalized RGB pixel.
+func luminance(r, g, b float64) float64 {
+	return 0.2126*r + 0.7152*g + 0.0722*b
+}
+
+// hueRotation rotates colors about the gray axis of the RGB cube.
+func hueRotation(degrees float64) pointOp {
+	rad := degrees * math.Pi / 180
+	cos, sin := math.Cos(rad), math.Sin(rad)
+	a := cos + (1-cos)/3
+	b := (1-cos)/3 - math.Sqrt(1.0/3)*sin
+	c := (1-cos)/3 + math.Sqrt(1.0/3)*sin
+	return func(r, g, bl float64) (float64, float64, float64) {
+		return a*r + b*g + c*bl, c*r + a*g + b*bl, b*r + c*g + a*bl
+	}
+}
+
+// levels stretches [black, white] to [0, 1] and then applies gamma.
+func levels(black, white, gamma float64) pointOp {
+	span := white - black
+	if span <= 0 {
+		span = 1.0 / 65535
+	}
+	inv := 1 / gamma
+	f := func(c float64) float64 {
+		return math.Pow(math.Min(1, math.Max(0, (c-black)/span)), inv)
+	}
+	return func(r, g, b float64) (float64, float64, float64) {
+		return f(r), f(g), f(b)
+	}
+}
+
+// fuse composes point operations into one. With clamp set it clamps between steps
+// exactly as separate passes through a uint16 image would.
+func fuse(ops []pointOp, clamp bool) pointOp {
+	clamp01 := func(c float64) float64 { return math.Min(1, math.Max(0, c)) }
+	return func(r, g, b float64) (float64, float64, float64) {
+		for _, op := range ops {
+			r, g, b = op(r, g, b)
+			if clamp {
+				r, g, b = clamp01(r), clamp01(g), clamp01(b)
+			}
+		}
+		return r, g, b
+	}
+}
+
+// applyPointOp maps every pixel in rows [start, end) of In through op into Out.
+func (img *Image) applyPointOp(op pointOp, start int, end int) {
+	bounds := img.In.Bounds()
+	quantized := img.quantized()
+	for y := start; y < end; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := pixel(img.In, x, y)
+			// Premultiplied images are adjusted on their unpremultiplied colors
+			scale := 65535.0
+			if img.Premultiplied {
+				if c[3] <= 0 {
+					setPixel(img.Out, x, y, c)
+					continue
+				}
+				scale = c[3]
+			}
+			r, g, b := op(c[0]/scale, c[1]/scale, c[2]/scale)
+			if quantized {
+				r, g, b = math.Min(1, math.Max(0, r)), math.Min(1, math.Max(0, g)), math.Min(1, math.Max(0, b))
+			}
+			setPixel(img.Out, x, y, [4]float64{r * scale, g * scale, b * scale, c[3]})
+		}
+	}
+}
+
+// Passes groups an effect list into the passes ApplyEffects makes over the image:
+// a run of consecutive point operations is fused into one pass, every other
+// effect gets a pass of its own.
+func Passes(effects []EffectSpec) [][]EffectSpec {
+	var passes [][]EffectSpec
+	for i := 0; i < len(effects); {
+		j := i + 1
+		if _, ok := effects[i].PointOp(); ok {
+			for j < len(effects) {
+				if _, ok := effects[j].PointOp(); !ok {
+					break
+				}
+				j++
+			}
+		}
+		passes = append(passes, effects[i:j])
+		i = j
+	}
+	return passes
+}
+
+// ApplyPass runs one pass from Passes from In into Out.
+func (img *Image) ApplyPass(pass []EffectSpec, e Effects, par bool, startY int, endY int) {
+	if len(pass) == 1 {
+		img.Apply(pass[0], e, par, startY, endY)
+		return
+	}
+	ops := make([]pointOp, len(pass))
+	for i, effect := range pass {
+		ops[i], _ = effect.pointOp(img.Linear)
+	}
+	start, end := img.rows(par, startY, endY)
+	img.applyPointOp(fuse(ops, img.quantized()), start, end)
+}
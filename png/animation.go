@@ -0,0 +1,201 @@
+package png
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+// How a frame is cleared before the next one is drawn, as in APNG's dispose_op.
+const (
+	DisposeNone       = 0 // leave the frame in place
+	DisposeBackground = 1 // clear the frame's area to transparent
+	DisposePrevious   = 2 // restore the canvas to what it was before the frame
+)
+
+// Frame is one frame of an animation. Its Image holds the whole canvas as it looks
+// while the frame is shown, so effects see the full picture rather than the part
+// the frame changed.
+type Frame struct {
+	Image    *Image
+	Delay    time.Duration // how long the frame is shown
+	Disposal int           // the source's disposal of the frame, one of the Dispose constants
+}
+
+// Animation is a multi-frame GIF or APNG. Frames are coalesced when decoded and
+// written back as full frames that each replace the last, with their source's
+// Disposal wherever it doesn't change what is shown.
+type Animation struct {
+	Frames []Frame
+	Loops  int    // how many times the animation plays, 0 for forever
+	Format string // "gif" or "png"
+}
+
+// DecodeAnimation reads every frame of an animated GIF or APNG from r. Still
+// images, including single-frame GIFs, and other formats give a nil Animation.
+func DecodeAnimation(r io.Reader) (*Animation, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return decodeAPNG(data)
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return decodeGIF(data)
+	}
+	return nil, nil
+}
+
+func decodeGIF(data []byte) (*Animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	anim := &Animation{Format: "gif", Loops: 0}
+	if g.LoopCount < 0 {
+		anim.Loops = 1
+	} else if g.LoopCount > 0 {
+		anim.Loops = g.LoopCount + 1
+	}
+	canvas := newCanvas(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		disposal := DisposeNone
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				disposal = DisposeBackground
+			case gif.DisposalPrevious:
+				disposal = DisposePrevious
+			}
+		}
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		img := canvas.draw(frame, frame.Bounds(), draw.Over, disposal)
+		img.Format, img.ColorModel = "gif", frame.ColorModel()
+		anim.Frames = append(anim.Frames, Frame{Image: img, Delay: time.Duration(delay) * 10 * time.Millisecond, Disposal: disposal})
+	}
+	return anim, nil
+}
+
+// canvas composites the frames of an animation.
+type canvas struct {
+	pix *image.RGBA64
+}
+
+func newCanvas(bounds image.Rectangle) *canvas {
+	return &canvas{pix: image.NewRGBA64(bounds)}
+}
+
+// draw composites m onto the area r of the canvas with op and returns the result
+// as an Image, then disposes of the frame for the next one.
+func (c *canvas) draw(m image.Image, r image.Rectangle, op draw.Op, disposal int) *Image {
+	var previous *image.RGBA64
+	if disposal == DisposePrevious {
+		previous = Crop(c.pix, c.pix.Bounds()).(*image.RGBA64)
+	}
+	draw.Draw(c.pix, r, m, m.Bounds().Min, op)
+	bounds := c.pix.Bounds()
+	img := &Image{In: Crop(c.pix, bounds), Out: newRGBA64(bounds), Bounds: bounds}
+	switch disposal {
+	case DisposeBackground:
+		draw.Draw(c.pix, r, image.Transparent, image.Point{}, draw.Src)
+	case DisposePrevious:
+		c.pix = previous
+	}
+	return img
+}
+
+// Encode writes the processed frames to w as an animated GIF when opts asks for
+// gif and as an APNG when it asks for png. Formats that can't animate get the
+// first frame.
+func (anim *Animation) Encode(w io.Writer, opts SaveOptions) error {
+	if len(anim.Frames) == 0 {
+		return fmt.Errorf("animation has no frames")
+	}
+	if opts.Format == "" {
+		opts.Format = "png"
+	}
+	format, err := FormatFor("", opts.Format)
+	if err != nil {
+		return err
+	}
+	bounds := anim.Frames[0].Image.Out.Bounds()
+	for i, frame := range anim.Frames {
+		if frame.Image.Out.Bounds() != bounds {
+			return fmt.Errorf("frame %d is %v, the first frame is %v", i, frame.Image.Out.Bounds(), bounds)
+		}
+	}
+	switch format {
+	case "gif":
+		return anim.encodeGIF(w)
+	case "png":
+		return anim.encodeAPNG(w, opts)
+	}
+	return anim.Frames[0].Image.Encode(w, opts)
+}
+
+// gifPalette is the palette still GIFs are quantized to, with its last entry made
+// transparent so cleared areas stay cleared.
+var gifPalette = append(color.Palette{}, append(palette.Plan9[:255:255], color.Transparent)...)
+
+func (anim *Animation) encodeGIF(w io.Writer) error {
+	g := &gif.GIF{LoopCount: 0}
+	if anim.Loops == 1 {
+		g.LoopCount = -1
+	} else if anim.Loops > 1 {
+		g.LoopCount = anim.Loops - 1
+	}
+	for _, frame := range anim.Frames {
+		bounds := frame.Image.Out.Bounds()
+		m := image.NewPaletted(bounds, gifPalette)
+		out := frame.Image.rgba64()
+		draw.FloydSteinberg.Draw(m, bounds, out, bounds.Min)
+		frame.Image.release(out)
+		g.Image = append(g.Image, m)
+		g.Delay = append(g.Delay, int(frame.Delay/(10*time.Millisecond)))
+	}
+	// GIF frames are drawn over what the last one left, so a frame keeps its own
+	// disposal only if that leaves nothing under the next frame's transparent
+	// pixels. Clearing to the background always does, as every frame is whole.
+	transparent := uint8(len(gifPalette) - 1)
+	empty := bytes.Repeat([]byte{transparent}, len(g.Image[0].Pix))
+	canvas := empty
+	for i, m := range g.Image {
+		disposal, left := byte(gif.DisposalBackground), empty
+		switch anim.Frames[i].Disposal {
+		case DisposeNone:
+			disposal, left = gif.DisposalNone, m.Pix
+		case DisposePrevious:
+			disposal, left = gif.DisposalPrevious, canvas
+		}
+		if i+1 < len(g.Image) && showsThrough(left, g.Image[i+1].Pix, transparent) {
+			disposal, left = gif.DisposalBackground, empty
+		}
+		g.Disposal = append(g.Disposal, disposal)
+		canvas = left
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// showsThrough reports whether any pixel of the canvas would show through a
+// transparent pixel of the next frame.
+func showsThrough(canvas []uint8, next []uint8, transparent uint8) bool {
+	for i, c := range next {
+		if c == transparent && canvas[i] != transparent {
+			return true
+		}
+	}
+	return false
+}
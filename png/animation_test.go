@@ -0,0 +1,49 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// TestGIFDisposalFallback checks that a frame whose disposal would leave pixels
+// showing through the next frame's transparent ones is cleared instead.
+func TestGIFDisposalFallback(t *testing.T) {
+	frame := func(hole bool, disposal int) Frame {
+		m := image.NewRGBA64(image.Rect(0, 0, 3, 2))
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				m.SetRGBA64(x, y, color.RGBA64{65535, 0, 0, 65535})
+			}
+		}
+		if hole {
+			m.SetRGBA64(1, 1, color.RGBA64{})
+		}
+		return Frame{Image: &Image{Out: m, Bounds: m.Rect}, Disposal: disposal}
+	}
+	for _, test := range []struct {
+		frames []Frame
+		want   []byte
+	}{
+		{[]Frame{frame(false, DisposeNone), frame(false, DisposeNone)}, []byte{gif.DisposalNone, gif.DisposalNone}},
+		{[]Frame{frame(false, DisposeNone), frame(true, DisposeNone)}, []byte{gif.DisposalBackground, gif.DisposalNone}},
+		{[]Frame{frame(true, DisposeNone), frame(true, DisposeNone)}, []byte{gif.DisposalNone, gif.DisposalNone}},
+		// Going back to the opaque first frame would fill the hole too
+		{[]Frame{frame(false, DisposeNone), frame(false, DisposePrevious), frame(true, DisposeNone)}, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone}},
+		{[]Frame{frame(false, DisposeBackground), frame(false, DisposePrevious), frame(true, DisposeNone)}, []byte{gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone}},
+	} {
+		var buf bytes.Buffer
+		if err := (&Animation{Frames: test.frames}).Encode(&buf, SaveOptions{Format: "gif"}); err != nil {
+			t.Fatal(err)
+		}
+		g, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(g.Disposal, test.want) {
+			t.Errorf("disposals %v, want %v", g.Disposal, test.want)
+		}
+	}
+}
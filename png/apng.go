@@ -0,0 +1,269 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+)
+
+// zlibLevels maps SaveOptions.Compression to the level APNG frames are deflated at.
+var zlibLevels = map[string]int{
+	"":        zlib.DefaultCompression,
+	"default": zlib.DefaultCompression,
+	"none":    zlib.NoCompression,
+	"speed":   zlib.BestSpeed,
+	"best":    zlib.BestCompression,
+}
+
+// apngFrame is a frame control chunk and the image data that follows it.
+type apngFrame struct {
+	control []byte
+	data    []byte
+}
+
+// decodeAPNG decodes every frame of an APNG by rebuilding each one as a still PNG
+// the standard decoder can read. A PNG without an animation control chunk, or with
+// a single frame, is a still image.
+func decodeAPNG(data []byte) (*Animation, error) {
+	var ihdr, actl []byte
+	var shared []Chunk
+	var frames []*apngFrame
+	walkChunks(data, func(typ string, body []byte) {
+		switch typ {
+		case "IHDR":
+			ihdr = body
+		case "PLTE", "tRNS":
+			shared = append(shared, Chunk{Type: typ, Data: body})
+		case "acTL":
+			actl = body
+		case "fcTL":
+			frames = append(frames, &apngFrame{control: body})
+		case "IDAT":
+			// image data before the first frame control is a default image that
+			// isn't part of the animation
+			if len(frames) > 0 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, body...)
+			}
+		case "fdAT":
+			if len(frames) > 0 && len(body) >= 4 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, body[4:]...)
+			}
+		}
+	})
+	if len(actl) < 8 || len(frames) < 2 || len(ihdr) != 13 {
+		return nil, nil
+	}
+	anim := &Animation{Format: "png", Loops: int(binary.BigEndian.Uint32(actl[4:]))}
+	be := binary.BigEndian
+	canvas := newCanvas(image.Rect(0, 0, int(be.Uint32(ihdr)), int(be.Uint32(ihdr[4:]))))
+	for i, frame := range frames {
+		c := frame.control
+		if len(c) < 26 {
+			return nil, fmt.Errorf("apng frame %d: short frame control chunk", i)
+		}
+		w, h := be.Uint32(c[4:]), be.Uint32(c[8:])
+		x, y := int(be.Uint32(c[12:])), int(be.Uint32(c[16:]))
+		num, den := be.Uint16(c[20:]), be.Uint16(c[22:])
+		disposal, blend := int(c[24]), c[25]
+
+		var still bytes.Buffer
+		still.WriteString(pngSignature)
+		header := append([]byte(nil), ihdr...)
+		be.PutUint32(header, w)
+		be.PutUint32(header[4:], h)
+		writeChunk(&still, "IHDR", header)
+		for _, chunk := range shared {
+			writeChunk(&still, chunk.Type, chunk.Data)
+		}
+		writeChunk(&still, "IDAT", frame.data)
+		writeChunk(&still, "IEND", nil)
+		m, err := png.Decode(&still)
+		if err != nil {
+			return nil, fmt.Errorf("apng frame %d: %v", i, err)
+		}
+
+		// The first frame has nothing to go back to
+		if i == 0 && disposal == DisposePrevious {
+			disposal = DisposeBackground
+		}
+		op := draw.Src
+		if blend == 1 {
+			op = draw.Over
+		}
+		if den == 0 {
+			den = 100
+		}
+		img := canvas.draw(m, image.Rect(x, y, x+int(w), y+int(h)), op, disposal)
+		img.Format, img.ColorModel = "png", m.ColorModel()
+		if i == 0 {
+			img.Chunks, img.Exif = readChunks(data), readExif(data)
+		}
+		delay := time.Duration(num) * time.Second / time.Duration(den)
+		anim.Frames = append(anim.Frames, Frame{Image: img, Delay: delay, Disposal: disposal})
+	}
+	return anim, nil
+}
+
+// encodeAPNG writes every frame in full, each replacing the one before, with the
+// first frame's metadata and the depth opts asks for.
+func (anim *Animation) encodeAPNG(w io.Writer, opts SaveOptions) error {
+	level, ok := zlibLevels[opts.Compression]
+	if !ok {
+		return fmt.Errorf("unknown png compression %q", opts.Compression)
+	}
+	first := anim.Frames[0].Image
+	bounds := first.Out.Bounds()
+	var colorType, depth byte
+	// Alpha is dropped only if no frame needs it, since they share one header
+	dropAlpha := opts.DropAlpha
+	for _, frame := range anim.Frames {
+		dropAlpha = dropAlpha && opaque(frame.Image.Out)
+	}
+	data := make([][]byte, len(anim.Frames))
+	for i, frame := range anim.Frames {
+		m, err := frame.Image.output(opts)
+		if err != nil {
+			return err
+		}
+		rows, ct, d := scanlines(m, dropAlpha)
+		frame.Image.release(m)
+		if i == 0 {
+			colorType, depth = ct, d
+		} else if ct != colorType || d != depth {
+			return fmt.Errorf("frame %d has a different color model from the first frame", i)
+		}
+		var buf bytes.Buffer
+		z, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			return err
+		}
+		z.Write(rows)
+		if err := z.Close(); err != nil {
+			return err
+		}
+		data[i] = buf.Bytes()
+	}
+
+	be := binary.BigEndian
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	be.PutUint32(ihdr, uint32(bounds.Dx()))
+	be.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8], ihdr[9] = depth, colorType
+	actl := make([]byte, 8)
+	be.PutUint32(actl, uint32(len(anim.Frames)))
+	be.PutUint32(actl[4:], uint32(anim.Loops))
+	chunks := append([]Chunk{{Type: "IHDR", Data: ihdr}, {Type: "acTL", Data: actl}}, first.metadata(opts)...)
+	seq := uint32(0)
+	for i, frame := range anim.Frames {
+		num, den := frame.Delay.Milliseconds(), int64(1000)
+		if num > 0xffff {
+			num, den = min(num/10, 0xffff), 100
+		}
+		fctl := make([]byte, 26)
+		be.PutUint32(fctl, seq)
+		be.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		be.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		be.PutUint16(fctl[20:], uint16(num))
+		be.PutUint16(fctl[22:], uint16(den))
+		// The next frame replaces this one in full, so the source's disposal is safe
+		fctl[24], fctl[25] = byte(frame.Disposal), 0
+		chunks = append(chunks, Chunk{Type: "fcTL", Data: fctl})
+		seq++
+		if i == 0 {
+			chunks = append(chunks, Chunk{Type: "IDAT", Data: data[i]})
+		} else {
+			chunks = append(chunks, Chunk{Type: "fdAT", Data: append(be.AppendUint32(nil, seq), data[i]...)})
+			seq++
+		}
+	}
+	chunks = append(chunks, Chunk{Type: "IEND"})
+	for _, chunk := range chunks {
+		if err := writeChunk(w, chunk.Type, chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanlines returns the Paeth-filtered rows of m with the PNG color type and bit
+// depth they are stored in. With dropAlpha, RGBA pixels are stored as RGB.
+func scanlines(m image.Image, dropAlpha bool) ([]byte, byte, byte) {
+	var pix []byte
+	var stride, bpp int
+	var colorType, depth byte
+	switch m := m.(type) {
+	case *image.Gray:
+		pix, stride, bpp, colorType, depth = m.Pix, m.Stride, 1, 0, 8
+	case *image.Gray16:
+		pix, stride, bpp, colorType, depth = m.Pix, m.Stride, 2, 0, 16
+	case *image.NRGBA:
+		pix, stride, bpp, colorType, depth = m.Pix, m.Stride, 4, 6, 8
+	default:
+		n := image.NewNRGBA64(m.Bounds())
+		draw.Draw(n, n.Bounds(), m, m.Bounds().Min, draw.Src)
+		pix, stride, bpp, colorType, depth = n.Pix, n.Stride, 8, 6, 16
+	}
+	if dropAlpha && colorType == 6 {
+		// Keep the first three of every four samples
+		sample := bpp / 4
+		rgb := make([]byte, 0, m.Bounds().Dx()*m.Bounds().Dy()*sample*3)
+		for y := 0; y < m.Bounds().Dy(); y++ {
+			row := pix[y*stride : y*stride+m.Bounds().Dx()*bpp]
+			for i := 0; i < len(row); i += bpp {
+				rgb = append(rgb, row[i:i+3*sample]...)
+			}
+		}
+		bpp = 3 * sample
+		pix, stride, colorType = rgb, m.Bounds().Dx()*bpp, 2
+	}
+	width := m.Bounds().Dx() * bpp
+	rows := make([]byte, 0, (width+1)*m.Bounds().Dy())
+	for y := 0; y < m.Bounds().Dy(); y++ {
+		row := pix[y*stride : y*stride+width]
+		rows = append(rows, 4)
+		for i := range row {
+			var a, b, c int
+			if i >= bpp {
+				a = int(row[i-bpp])
+			}
+			if y > 0 {
+				up := pix[(y-1)*stride:]
+				b = int(up[i])
+				if i >= bpp {
+					c = int(up[i-bpp])
+				}
+			}
+			rows = append(rows, row[i]-paeth(a, b, c))
+		}
+	}
+	return rows, colorType, depth
+}
+
+// paeth predicts a byte from its left, upper and upper-left neighbours.
+func paeth(a int, b int, c int) byte {
+	p := a + b - c
+	pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+	if pa <= pb && pa <= pc {
+		return byte(a)
+	}
+	if pb <= pc {
+		return byte(b)
+	}
+	return byte(c)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,56 @@
+package png
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is an output file that only appears at its path once complete.
+// Writes go to a temporary file in the same directory, which Close renames into
+// place, so a crash never leaves a truncated image behind. Abort discards it.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic starts writing the file at path.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Close flushes the temporary file and renames it to the final path.
+func (f *AtomicFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	err := f.File.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.File.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+	}
+	return err
+}
+
+// Abort removes the temporary file, leaving whatever was at path untouched.
+func (f *AtomicFile) Abort() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
@@ -0,0 +1,12 @@
+//go:build !amd64 || !avx2
+
+package png
+
+// fftFloatKernelSize is the smallest kernel the FFT convolves a float buffer
+// faster than planar tiles do.
+const fftFloatKernelSize = 11
+
+// axpy adds k times src to dst.
+func axpy(dst []float32, src []float32, k float32) {
+	axpyGo(dst, src, k)
+}
@@ -0,0 +1,37 @@
+//go:build avx2
+
+package png
+
+// Built with the avx2 tag, axpy runs eight lanes at a time on CPUs that have AVX2
+// and falls back to axpyGo on the others. It multiplies and adds without fusing,
+// so both round the same way.
+
+// hasAVX2 reports whether the CPU and the OS support AVX2.
+var hasAVX2 = cpuHasAVX2()
+
+// fftFloatKernelSize is the smallest kernel the FFT convolves a float buffer
+// faster than planar tiles do.
+var fftFloatKernelSize = func() int {
+	if hasAVX2 {
+		return 19
+	}
+	return 11
+}()
+
+func cpuHasAVX2() bool
+
+//go:noescape
+func axpyAVX2(dst *float32, src *float32, n int, k float32)
+
+// axpy adds k times src to dst.
+func axpy(dst []float32, src []float32, k float32) {
+	src = src[:len(dst)]
+	n := 0
+	if hasAVX2 {
+		n = len(dst) &^ 7
+	}
+	if n > 0 {
+		axpyAVX2(&dst[0], &src[0], n, k)
+	}
+	axpyGo(dst[n:], src[n:], k)
+}
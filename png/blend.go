@@ -0,0 +1,106 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// blendModes combine a backdrop channel b with a source channel s, both
+// normalized and unpremultiplied, as the W3C compositing spec defines them.
+var blendModes = map[string]func(b, s float64) float64{
+	"normal":   func(b, s float64) float64 { return s },
+	"multiply": func(b, s float64) float64 { return b * s },
+	"screen":   screen,
+	"overlay": func(b, s float64) float64 {
+		if b <= 0.5 {
+			return 2 * b * s
+		}
+		return screen(2*b-1, s)
+	},
+	"difference": func(b, s float64) float64 { return math.Abs(b - s) },
+}
+
+func screen(b, s float64) float64 {
+	return b + s - b*s
+}
+
+// Preparation describes what PrepareImage does to the image for parameter key
+// before the effect reads it, or is empty if the image is read as it is. Effects
+// that agree on it can share one prepared copy.
+func (spec EffectSpec) Preparation(key string, linear bool) string {
+	if spec.Name != "blend" || key != "image" {
+		return ""
+	}
+	var steps []string
+	if linear {
+		steps = append(steps, "linear")
+	}
+	if scale := spec.Float("scale", 1); scale != 1 {
+		steps = append(steps, fmt.Sprintf("scale %v %s", scale, spec.String("filter", "bilinear")))
+	}
+	return strings.Join(steps, " ")
+}
+
+// PrepareImage returns m, the image for parameter key, as the effect reads it:
+// the secondary image of a blend converted to linear light if linear is set, for
+// a decoded sRGB image in a linear task, then scaled by "scale" with "filter".
+func (spec EffectSpec) PrepareImage(key string, m Buffer, linear bool) Buffer {
+	if spec.Preparation(key, linear) == "" {
+		return m
+	}
+	b := m.Bounds()
+	if linear {
+		img := &Image{In: NewFloat(b)}
+		CopyRect(img.In, b, m, b.Min)
+		img.Linearize()
+		m = img.In
+	}
+	if scale := spec.Float("scale", 1); scale != 1 {
+		w, h := int(math.Round(float64(b.Dx())*scale)), int(math.Round(float64(b.Dy())*scale))
+		m = Resize(m, w, h, spec.String("filter", "bilinear"))
+	}
+	return m
+}
+
+// Blend composites the effect's secondary image over rows [start, end) of In into
+// Out. The image, already prepared by PrepareImage and so in the same light as In,
+// is placed with its top left corner at "x", "y", mixed with the backdrop by "mode"
+// and laid over it with "opacity" times its own alpha.
+func (img *Image) Blend(effect EffectSpec, start int, end int) {
+	overlay, ok := effect.Images["image"]
+	if !ok {
+		panic(fmt.Sprintf("blend image %q is not loaded", effect.String("image", "")))
+	}
+	mode := blendModes[effect.String("mode", "normal")]
+	opacity := effect.Float("opacity", 1)
+	at := image.Pt(int(math.Round(effect.Float("x", 0))), int(math.Round(effect.Float("y", 0))))
+	offset := at.Sub(overlay.Bounds().Min)
+
+	bounds := img.In.Bounds()
+	for y := start; y < end; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cb := pixel(img.In, x, y)
+			cs := pixel(overlay, x-offset.X, y-offset.Y)
+			as := cs[3] / 65535 * opacity
+			if as <= 0 {
+				setPixel(img.Out, x, y, cb)
+				continue
+			}
+			ab := cb[3] / 65535
+			var out [4]float64
+			for ch := 0; ch < 3; ch++ {
+				s := cs[ch] / cs[3]
+				var b float64
+				if ab > 0 {
+					b = cb[ch] / cb[3]
+				}
+				mixed := (1-ab)*s + ab*mode(b, s)
+				out[ch] = as*mixed*65535 + (1-as)*cb[ch]
+			}
+			out[3] = (as + ab*(1-as)) * 65535
+			setPixel(img.Out, x, y, out)
+		}
+	}
+}
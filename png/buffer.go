@@ -0,0 +1,151 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Buffer holds the pixels of an Image, alpha-premultiplied. An *image.RGBA64 rounds
+// and clamps every pass to 16 bits; a *Float keeps float32 values between passes.
+// Effects work on either through pixel and setPixel, in 0..65535 units.
+type Buffer interface {
+	draw.RGBA64Image
+}
+
+// Float is an image of alpha-premultiplied float32 RGBA pixels where 1 is full
+// intensity. Values aren't clamped, so they may leave 0..1 between effects; the
+// color methods clamp and round to 16 bits.
+type Float struct {
+	Pix    []float32
+	Stride int
+	Rect   image.Rectangle
+}
+
+// NewFloat returns a transparent Float with the given bounds, from the buffer pools.
+func NewFloat(r image.Rectangle) *Float {
+	return &Float{Pix: newFloatPix(r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+func (m *Float) ColorModel() color.Model { return color.RGBA64Model }
+
+func (m *Float) Bounds() image.Rectangle { return m.Rect }
+
+// PixOffset returns the index of the first element of Pix for the pixel at (x, y).
+func (m *Float) PixOffset(x int, y int) int {
+	return (y-m.Rect.Min.Y)*m.Stride + (x-m.Rect.Min.X)*4
+}
+
+func (m *Float) At(x int, y int) color.Color {
+	return m.RGBA64At(x, y)
+}
+
+func (m *Float) RGBA64At(x int, y int) color.RGBA64 {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return color.RGBA64{}
+	}
+	i := m.PixOffset(x, y)
+	a := quantize(float64(m.Pix[i+3]), 1)
+	return color.RGBA64{
+		R: quantize(float64(m.Pix[i]), float64(a)/65535),
+		G: quantize(float64(m.Pix[i+1]), float64(a)/65535),
+		B: quantize(float64(m.Pix[i+2]), float64(a)/65535),
+		A: a,
+	}
+}
+
+func (m *Float) Set(x int, y int, c color.Color) {
+	m.SetRGBA64(x, y, color.RGBA64Model.Convert(c).(color.RGBA64))
+}
+
+func (m *Float) SetRGBA64(x int, y int, c color.RGBA64) {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return
+	}
+	i := m.PixOffset(x, y)
+	m.Pix[i] = float32(c.R) / 65535
+	m.Pix[i+1] = float32(c.G) / 65535
+	m.Pix[i+2] = float32(c.B) / 65535
+	m.Pix[i+3] = float32(c.A) / 65535
+}
+
+// quantize rounds a normalized channel value to 16 bits, clamped to [0, limit].
+func quantize(v float64, limit float64) uint16 {
+	return uint16(math.Min(limit, math.Max(0, v))*65535 + 0.5)
+}
+
+// NewBuffer returns an empty buffer of the same kind as like with the given bounds,
+// from the buffer pools.
+func NewBuffer(like Buffer, r image.Rectangle) Buffer {
+	if _, ok := like.(*Float); ok {
+		return NewFloat(r)
+	}
+	return newRGBA64(r)
+}
+
+// quantized reports whether the image rounds and clamps to 16 bits after every pass.
+func (img *Image) quantized() bool {
+	_, ok := img.In.(*Float)
+	return !ok
+}
+
+// pixel returns the channels of the pixel at (x, y) in 0..65535 units. Pixels
+// outside the bounds are transparent black.
+func pixel(m Buffer, x int, y int) [4]float64 {
+	if !(image.Point{x, y}.In(m.Bounds())) {
+		return [4]float64{}
+	}
+	switch m := m.(type) {
+	case *Float:
+		i := m.PixOffset(x, y)
+		return [4]float64{float64(m.Pix[i]) * 65535, float64(m.Pix[i+1]) * 65535, float64(m.Pix[i+2]) * 65535, float64(m.Pix[i+3]) * 65535}
+	}
+	c := m.RGBA64At(x, y)
+	return [4]float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+}
+
+// setPixel stores channels in 0..65535 units at (x, y). A 16-bit buffer clamps
+// them as Clamp does; a Float keeps them as they are. Pixels outside the bounds
+// are left alone.
+func setPixel(m Buffer, x int, y int, c [4]float64) {
+	switch m := m.(type) {
+	case *Float:
+		if !(image.Point{x, y}.In(m.Rect)) {
+			return
+		}
+		i := m.PixOffset(x, y)
+		m.Pix[i] = float32(c[0] / 65535)
+		m.Pix[i+1] = float32(c[1] / 65535)
+		m.Pix[i+2] = float32(c[2] / 65535)
+		m.Pix[i+3] = float32(c[3] / 65535)
+		return
+	}
+	m.SetRGBA64(x, y, color.RGBA64{Clamp(c[0]), Clamp(c[1]), Clamp(c[2]), Clamp(c[3])})
+}
+
+// CopyRect copies the part of src that lines up with r in dst, starting at sp,
+// without any loss when both buffers are of the same kind. As with draw.Draw, only
+// the part of r inside both dst and the translated src is written.
+func CopyRect(dst Buffer, r image.Rectangle, src Buffer, sp image.Point) {
+	clipped := r.Intersect(dst.Bounds()).Intersect(src.Bounds().Add(r.Min.Sub(sp)))
+	sp, r = sp.Add(clipped.Min.Sub(r.Min)), clipped
+	d, dok := dst.(*Float)
+	s, sok := src.(*Float)
+	switch {
+	case !dok:
+		// A Float source rounds to 16 bits in RGBA64At
+		draw.Draw(dst, r, src, sp, draw.Src)
+	case !sok:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				setPixel(dst, x, y, pixel(src, sp.X+x-r.Min.X, sp.Y+y-r.Min.Y))
+			}
+		}
+	default:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			sy := sp.Y + y - r.Min.Y
+			copy(d.Pix[d.PixOffset(r.Min.X, y):d.PixOffset(r.Max.X, y)], s.Pix[s.PixOffset(sp.X, sy):s.PixOffset(sp.X+r.Dx(), sy)])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// TestCopyRectClips copies rectangles hanging off one side or another of dst and
+// src between every pair of buffer kinds, which must write what draw.Draw writes
+// between 16-bit buffers and nothing outside either.
+func TestCopyRectClips(t *testing.T) {
+	fill := func(r image.Rectangle, base uint16) *image.RGBA64 {
+		m := image.NewRGBA64(r)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.SetRGBA64(x, y, color.RGBA64{base + uint16(x*100), base + uint16(y*100), base, 65535})
+			}
+		}
+		return m
+	}
+	kind := func(m *image.RGBA64, float bool) Buffer {
+		if !float {
+			c := image.NewRGBA64(m.Rect)
+			copy(c.Pix, m.Pix)
+			return c
+		}
+		f := NewFloat(m.Rect)
+		CopyRect(f, m.Rect, m, m.Rect.Min)
+		return f
+	}
+	dstRGBA, srcRGBA := fill(image.Rect(0, 0, 6, 5), 1000), fill(image.Rect(10, 20, 14, 23), 30000)
+	for _, test := range []struct {
+		r  image.Rectangle
+		sp image.Point
+	}{
+		{image.Rect(1, 1, 4, 3), image.Pt(10, 20)},  // inside both
+		{image.Rect(-2, -1, 8, 7), image.Pt(9, 19)}, // over every edge of dst and src
+		{image.Rect(0, 0, 6, 5), image.Pt(12, 21)},  // past the bottom right of src
+		{image.Rect(2, 2, 6, 5), image.Pt(8, 18)},   // before the top left of src
+		{image.Rect(2, 2, 6, 5), image.Pt(30, 30)},  // src entirely outside
+	} {
+		want := kind(dstRGBA, false).(*image.RGBA64)
+		draw.Draw(want, test.r, srcRGBA, test.sp, draw.Src)
+		for _, dstFloat := range []bool{false, true} {
+			for _, srcFloat := range []bool{false, true} {
+				dst := kind(dstRGBA, dstFloat)
+				CopyRect(dst, test.r, kind(srcRGBA, srcFloat), test.sp)
+				for y := 0; y < 5; y++ {
+					for x := 0; x < 6; x++ {
+						if got := dst.RGBA64At(x, y); got != want.RGBA64At(x, y) {
+							t.Errorf("%v from %v, float %v to float %v: (%d, %d) is %v, want %v", test.r, test.sp, srcFloat, dstFloat, x, y, got, want.RGBA64At(x, y))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Writes outside a Float are dropped rather than landing on another pixel
+	f := NewFloat(image.Rect(0, 0, 2, 2))
+	for _, p := range []image.Point{{-1, 0}, {2, 0}, {0, -1}, {0, 2}, {5, 5}} {
+		setPixel(f, p.X, p.Y, [4]float64{65535, 65535, 65535, 65535})
+	}
+	for i, v := range f.Pix {
+		if v != 0 {
+			t.Fatalf("a write outside the bounds set element %d to %v", i, v)
+		}
+	}
+}
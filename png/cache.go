@@ -0,0 +1,260 @@
+package png
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version identifies the effect implementations. It is part of every cache key,
+// so bumping it whenever an effect's output changes invalidates stale results.
+const Version = "7"
+
+// Cache is an on-disk, content-addressed store of effect results. A result is
+// keyed by the hash of the input pixels and the effects applied so far, so the
+// cache holds an entry after every pass of a chain and chains that share a prefix
+// (["G","B"] and ["G","B","E"]) share those entries. When MaxBytes is positive the
+// least recently used entries are evicted to stay under it. A Cache is safe for
+// concurrent use.
+type Cache struct {
+	Dir      string
+	MaxBytes int64
+
+	mu    sync.Mutex
+	total int64
+}
+
+// NewCache opens (creating if needed) the cache in dir.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Cache{Dir: dir, MaxBytes: maxBytes}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		c.total += entry.Size()
+	}
+	return c, nil
+}
+
+// Apply runs effects over img like ApplyEffects, leaving the result in Out, but
+// starts from the longest prefix of the chain found in the cache and stores the
+// result of every pass it runs. apply runs one pass from In into Out, so callers
+// choose how a pass is executed (whole image or chunked). As with ApplyEffects,
+// Out and the intermediate images go back to the buffer pools and In is left as
+// it was.
+func (c *Cache) Apply(img *Image, effects []EffectSpec, apply func(img *Image, pass []EffectSpec)) {
+	passes := Passes(effects)
+	keys := c.keys(img, passes)
+	in := img.In
+	done := func(m Buffer) {
+		if m != nil && m != in && m != img.In && m != img.Out {
+			PutBuffer(m)
+		}
+	}
+	if img.Out != in {
+		PutBuffer(img.Out)
+		img.Out = nil
+	}
+	start := 0
+	for i := len(passes); i > 0; i-- {
+		if cached := c.load(keys[i-1], img.In); cached != nil {
+			img.In = cached
+			start = i
+			break
+		}
+	}
+	for i := start; i < len(passes); i++ {
+		prev, out := img.In, NewBuffer(img.In, img.In.Bounds())
+		img.Out = out
+		apply(img, passes[i])
+		c.store(keys[i], img.Out)
+		img.In = img.Out
+		done(prev)
+		done(out)
+	}
+	img.In, img.Out = in, img.In
+	img.Bounds = img.Out.Bounds()
+}
+
+// keys returns the cache key after each pass: a hash chain that starts from the
+// version and input pixels and folds in one pass at a time.
+func (c *Cache) keys(img *Image, passes [][]EffectSpec) []string {
+	h := sha256.New()
+	io.WriteString(h, Version)
+	b := img.In.Bounds()
+	binary.Write(h, binary.LittleEndian, [4]int64{int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y)})
+	binary.Write(h, binary.LittleEndian, img.Premultiplied)
+	// The same pixels read differently in linear light, by blend among others
+	binary.Write(h, binary.LittleEndian, img.Linear)
+	// Float buffers give different results from 16-bit ones with the same pixels
+	if _, ok := img.In.(*Float); ok {
+		io.WriteString(h, "float32")
+	}
+	writePixels(h, img.In)
+	prev := h.Sum(nil)
+	keys := make([]string, len(passes))
+	for i, pass := range passes {
+		spec, err := json.Marshal(pass)
+		if err != nil {
+			panic(err)
+		}
+		h := sha256.New()
+		h.Write(prev)
+		h.Write(spec)
+		HashImages(h, pass)
+		prev = h.Sum(nil)
+		keys[i] = hex.EncodeToString(prev)
+	}
+	return keys
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key+".px")
+}
+
+// load returns the cached image for key, a buffer of the same kind as like, or
+// nil on a miss.
+func (c *Cache) load(key string, like Buffer) Buffer {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var rect [4]int64
+	if err := binary.Read(r, binary.LittleEndian, &rect); err != nil {
+		return nil
+	}
+	m := NewBuffer(like, image.Rect(int(rect[0]), int(rect[1]), int(rect[2]), int(rect[3])))
+	switch m := m.(type) {
+	case *image.RGBA64:
+		if _, err := io.ReadFull(r, m.Pix); err != nil {
+			return nil
+		}
+	case *Float:
+		if err := binary.Read(r, binary.LittleEndian, m.Pix); err != nil {
+			return nil
+		}
+	}
+	// Touch the entry so eviction sees it as recently used
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return m
+}
+
+// store writes m under key and evicts old entries if the cache grew too large.
+// Failures only cost a future cache miss, so they are ignored.
+func (c *Cache) store(key string, m Buffer) {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	f, err := CreateAtomic(path)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	b := m.Bounds()
+	binary.Write(w, binary.LittleEndian, [4]int64{int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y)})
+	size := writePixels(w, m)
+	if err := w.Flush(); err != nil {
+		f.Abort()
+		return
+	}
+	if err := f.Close(); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += 32 + size
+	if c.MaxBytes > 0 && c.total > c.MaxBytes {
+		c.evict()
+	}
+}
+
+// writePixels writes the rows of m to w, little endian for float buffers, and
+// returns the number of bytes written.
+func writePixels(w io.Writer, m Buffer) int64 {
+	b := m.Bounds()
+	var size int64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		switch m := m.(type) {
+		case *image.RGBA64:
+			row := m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)]
+			w.Write(row)
+			size += int64(len(row))
+		case *Float:
+			row := m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)]
+			binary.Write(w, binary.LittleEndian, row)
+			size += 4 * int64(len(row))
+		}
+	}
+	return size
+}
+
+// HashImages writes the pixels of the image files the effects were given to w, so
+// that hashes of an effect chain change with the files and not just their names.
+func HashImages(w io.Writer, effects []EffectSpec) {
+	for _, effect := range effects {
+		for _, key := range effect.ImageFiles() {
+			if m, ok := effect.Images[key]; ok {
+				writePixels(w, m)
+			}
+		}
+	}
+}
+
+// entries lists the cache files.
+func (c *Cache) entries() ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".px") {
+			entries = append(entries, info)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// evict removes least recently used entries until the cache fits in MaxBytes.
+// It rescans the directory, so other processes sharing the cache are accounted for.
+func (c *Cache) evict() {
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	c.total = 0
+	for _, entry := range entries {
+		c.total += entry.Size()
+	}
+	for _, entry := range entries {
+		if c.total <= c.MaxBytes {
+			break
+		}
+		key := strings.TrimSuffix(entry.Name(), ".px")
+		if os.Remove(c.path(key)) == nil {
+			c.total -= entry.Size()
+		}
+	}
+}
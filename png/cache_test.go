@@ -0,0 +1,20 @@
+package png
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCacheKeysTellLinearApart(t *testing.T) {
+	c, err := NewCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passes := Passes(Specs("B"))
+	in := NewFloat(image.Rect(0, 0, 4, 4))
+	srgb := c.keys(&Image{In: in}, passes)
+	linear := c.keys(&Image{In: in, Linear: true}, passes)
+	if srgb[0] == linear[0] {
+		t.Error("the same pixels in linear light and in sRGB share a cache key")
+	}
+}
@@ -0,0 +1,277 @@
+package png
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// colorSpace converts normalized sRGB-encoded colors to and from three channels
+// that are each stored in 0..1.
+type colorSpace struct {
+	channels [3]string
+	from     func(c [3]float64) [3]float64 // from RGB
+	to       func(c [3]float64) [3]float64 // back to RGB
+}
+
+var colorSpaces = map[string]colorSpace{
+	"rgb":   {[3]string{"R", "G", "B"}, identity, identity},
+	"hsv":   {[3]string{"H", "S", "V"}, rgbToHSV, hsvToRGB},
+	"hsl":   {[3]string{"H", "S", "L"}, rgbToHSL, hslToRGB},
+	"lab":   {[3]string{"L", "a", "b"}, rgbToLab, labToRGB},
+	"ycbcr": {[3]string{"Y", "Cb", "Cr"}, rgbToYCbCr, ycbcrToRGB},
+}
+
+func identity(c [3]float64) [3]float64 { return c }
+
+// selected returns which channels of the space a comma separated list names,
+// with alpha ("A") last; an empty list names the color channels. ok is false if
+// the list has a name the space lacks.
+func (space colorSpace) selected(list string) (keep [4]bool, ok bool) {
+	if list == "" {
+		return [4]bool{true, true, true, false}, true
+	}
+	for _, name := range strings.Split(list, ",") {
+		found := false
+		for i, channel := range append(space.channels[:], "A") {
+			if strings.TrimSpace(name) == channel {
+				keep[i], found = true, true
+			}
+		}
+		if !found {
+			return keep, false
+		}
+	}
+	return keep, true
+}
+
+// convert returns the point operation that converts from one space to another.
+// Color spaces are defined on sRGB-encoded colors, so an image in linear light is
+// encoded on the way in and decoded on the way out.
+func convert(from string, to string, linear bool) pointOp {
+	src, dst := colorSpaces[from], colorSpaces[to]
+	return func(r, g, b float64) (float64, float64, float64) {
+		c := [3]float64{r, g, b}
+		if from == "rgb" && linear {
+			c = mapRGB(c, linearToSRGB)
+		}
+		c = dst.from(src.to(c))
+		if to == "rgb" && linear {
+			c = mapRGB(c, srgbToLinear)
+		}
+		return c[0], c[1], c[2]
+	}
+}
+
+func mapRGB(c [3]float64, f func(float64) float64) [3]float64 {
+	return [3]float64{f(math.Max(0, c[0])), f(math.Max(0, c[1])), f(math.Max(0, c[2]))}
+}
+
+// applyInSpace runs an effect on some channels of a color space: the rows it
+// reads are converted, the effect runs on the unpremultiplied channel values, and
+// only the listed channels of the result are converted back. Alpha is filtered as
+// a separate gray image.
+func (img *Image) applyInSpace(effect EffectSpec, spaceName string, channels string, e Effects, par bool, startY int, endY int) {
+	space := colorSpaces[spaceName]
+	keep, _ := space.selected(channels)
+	from := convert("rgb", spaceName, img.Linear)
+	to := convert(spaceName, "rgb", img.Linear)
+
+	start, end := img.rows(par, startY, endY)
+	bounds := img.In.Bounds()
+	region := image.Rect(bounds.Min.X, start-effect.Halo(), bounds.Max.X, end+effect.Halo()).Intersect(bounds)
+	conv := &Image{In: NewBuffer(img.In, region), Out: NewBuffer(img.In, region), Bounds: region, Linear: img.Linear}
+	defer func() { PutBuffer(conv.In); PutBuffer(conv.Out) }()
+	var alpha *Image
+	if keep[3] {
+		alpha = &Image{In: NewBuffer(img.In, region), Out: NewBuffer(img.In, region), Bounds: region}
+		defer func() { PutBuffer(alpha.In); PutBuffer(alpha.Out) }()
+	}
+	var black [3]float64
+	black[0], black[1], black[2] = from(0, 0, 0)
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			c := pixel(img.In, x, y)
+			v := black
+			if c[3] > 0 {
+				v[0], v[1], v[2] = from(c[0]/c[3], c[1]/c[3], c[2]/c[3])
+			}
+			setPixel(conv.In, x, y, [4]float64{v[0] * 65535, v[1] * 65535, v[2] * 65535, c[3]})
+			if alpha != nil {
+				setPixel(alpha.In, x, y, [4]float64{c[3], c[3], c[3], 65535})
+			}
+		}
+	}
+	if keep[0] || keep[1] || keep[2] {
+		conv.Apply(effect, e, true, start, end)
+	}
+	if alpha != nil {
+		alpha.Apply(effect, e, true, start, end)
+	}
+	for y := start; y < end; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := pixel(conv.In, x, y)
+			if keep[0] || keep[1] || keep[2] {
+				filtered := pixel(conv.Out, x, y)
+				for ch := 0; ch < 3; ch++ {
+					if keep[ch] {
+						c[ch] = filtered[ch]
+					}
+				}
+			}
+			if alpha != nil {
+				c[3] = math.Min(65535, math.Max(0, pixel(alpha.Out, x, y)[0]))
+			}
+			if c[3] <= 0 {
+				setPixel(img.Out, x, y, [4]float64{})
+				continue
+			}
+			r, g, b := to(c[0]/65535, c[1]/65535, c[2]/65535)
+			setPixel(img.Out, x, y, [4]float64{r * c[3], g * c[3], b * c[3], c[3]})
+		}
+	}
+}
+
+// Hue is stored as a fraction of a turn.
+
+func rgbToHSV(c [3]float64) [3]float64 {
+	max := math.Max(c[0], math.Max(c[1], c[2]))
+	min := math.Min(c[0], math.Min(c[1], c[2]))
+	s := 0.0
+	if max > 0 {
+		s = (max - min) / max
+	}
+	return [3]float64{hue(c, max, min), s, max}
+}
+
+func hsvToRGB(c [3]float64) [3]float64 {
+	h, s, v := c[0], c[1], c[2]
+	return fromHue(h, v*s, v-v*s)
+}
+
+func rgbToHSL(c [3]float64) [3]float64 {
+	max := math.Max(c[0], math.Max(c[1], c[2]))
+	min := math.Min(c[0], math.Min(c[1], c[2]))
+	l := (max + min) / 2
+	s := 0.0
+	if d := 1 - math.Abs(2*l-1); d > 0 {
+		s = (max - min) / d
+	}
+	return [3]float64{hue(c, max, min), s, l}
+}
+
+func hslToRGB(c [3]float64) [3]float64 {
+	h, s, l := c[0], c[1], c[2]
+	chroma := (1 - math.Abs(2*l-1)) * s
+	return fromHue(h, chroma, l-chroma/2)
+}
+
+// hue returns the hue of an RGB color as a fraction of a turn.
+func hue(c [3]float64, max float64, min float64) float64 {
+	d := max - min
+	if d <= 0 {
+		return 0
+	}
+	var h float64
+	switch max {
+	case c[0]:
+		h = math.Mod((c[1]-c[2])/d, 6)
+	case c[1]:
+		h = (c[2]-c[0])/d + 2
+	default:
+		h = (c[0]-c[1])/d + 4
+	}
+	if h < 0 {
+		h += 6
+	}
+	return h / 6
+}
+
+// fromHue builds the RGB color with the given hue and chroma, offset by m.
+func fromHue(h float64, chroma float64, m float64) [3]float64 {
+	h = math.Mod(h, 1)
+	if h < 0 {
+		h++
+	}
+	h *= 6
+	x := chroma * (1 - math.Abs(math.Mod(h, 2)-1))
+	var c [3]float64
+	switch int(h) {
+	case 0:
+		c = [3]float64{chroma, x, 0}
+	case 1:
+		c = [3]float64{x, chroma, 0}
+	case 2:
+		c = [3]float64{0, chroma, x}
+	case 3:
+		c = [3]float64{0, x, chroma}
+	case 4:
+		c = [3]float64{x, 0, chroma}
+	default:
+		c = [3]float64{chroma, 0, x}
+	}
+	return [3]float64{c[0] + m, c[1] + m, c[2] + m}
+}
+
+// CIE Lab relative to the D65 white point. L is stored divided by 100 and a, b
+// offset by 128 and divided by 255.
+
+const labDelta = 6.0 / 29
+
+var d65 = [3]float64{0.95047, 1, 1.08883}
+
+func rgbToLab(c [3]float64) [3]float64 {
+	r, g, b := srgbToLinear(c[0]), srgbToLinear(c[1]), srgbToLinear(c[2])
+	xyz := [3]float64{
+		0.4124564*r + 0.3575761*g + 0.1804375*b,
+		0.2126729*r + 0.7151522*g + 0.0721750*b,
+		0.0193339*r + 0.1191920*g + 0.9503041*b,
+	}
+	var f [3]float64
+	for i := range f {
+		t := xyz[i] / d65[i]
+		if t > labDelta*labDelta*labDelta {
+			f[i] = math.Cbrt(t)
+		} else {
+			f[i] = t/(3*labDelta*labDelta) + 4.0/29
+		}
+	}
+	l, a, bb := 116*f[1]-16, 500*(f[0]-f[1]), 200*(f[1]-f[2])
+	return [3]float64{l / 100, (a + 128) / 255, (bb + 128) / 255}
+}
+
+func labToRGB(c [3]float64) [3]float64 {
+	l, a, b := c[0]*100, c[1]*255-128, c[2]*255-128
+	fy := (l + 16) / 116
+	f := [3]float64{fy + a/500, fy, fy - b/200}
+	var xyz [3]float64
+	for i := range f {
+		if f[i] > labDelta {
+			xyz[i] = f[i] * f[i] * f[i] * d65[i]
+		} else {
+			xyz[i] = 3 * labDelta * labDelta * (f[i] - 4.0/29) * d65[i]
+		}
+	}
+	x, y, z := xyz[0], xyz[1], xyz[2]
+	return [3]float64{
+		linearToSRGB(math.Max(0, 3.2404542*x-1.5371385*y-0.4985314*z)),
+		linearToSRGB(math.Max(0, -0.9692660*x+1.8760108*y+0.0415560*z)),
+		linearToSRGB(math.Max(0, 0.0556434*x-0.2040259*y+1.0572252*z)),
+	}
+}
+
+// Full range BT.601 YCbCr, as in JPEG, with Cb and Cr offset by one half.
+
+func rgbToYCbCr(c [3]float64) [3]float64 {
+	r, g, b := c[0], c[1], c[2]
+	return [3]float64{
+		0.299*r + 0.587*g + 0.114*b,
+		-0.168736*r - 0.331264*g + 0.5*b + 0.5,
+		0.5*r - 0.418688*g - 0.081312*b + 0.5,
+	}
+}
+
+func ycbcrToRGB(c [3]float64) [3]float64 {
+	y, cb, cr := c[0], c[1]-0.5, c[2]-0.5
+	return [3]float64{y + 1.402*cr, y - 0.344136*cb - 0.714136*cr, y + 1.772*cb}
+}
@@ -0,0 +1,98 @@
+package png
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// TestColorSpaceRoundTrip converts a grid of sRGB colors into every space and
+// back, in sRGB and in linear light. The channels must stay in 0..1 on the way, and
+// the colors come back well within a 16-bit step; Lab's matrices are only inverse
+// to seven digits.
+func TestColorSpaceRoundTrip(t *testing.T) {
+	const steps = 8
+	for name := range colorSpaces {
+		for _, linear := range []bool{false, true} {
+			from, to := convert("rgb", name, linear), convert(name, "rgb", linear)
+			for r := 0; r < steps; r++ {
+				for g := 0; g < steps; g++ {
+					for b := 0; b < steps; b++ {
+						c := [3]float64{float64(r) / (steps - 1), float64(g) / (steps - 1), float64(b) / (steps - 1)}
+						var v, back [3]float64
+						v[0], v[1], v[2] = from(c[0], c[1], c[2])
+						back[0], back[1], back[2] = to(v[0], v[1], v[2])
+						for i := range c {
+							if v[i] < -1e-5 || v[i] > 1+1e-5 {
+								t.Errorf("%s, linear %v: %v has %s %v", name, linear, c, colorSpaces[name].channels[i], v[i])
+							}
+							if math.Abs(back[i]-c[i]) > 1e-5 {
+								t.Errorf("%s, linear %v: %v came back as %v", name, linear, c, back)
+								break
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestLabLightnessOnly sharpens L alone, which must leave a and b as they were.
+func TestLabLightnessOnly(t *testing.T) {
+	src := NewFloat(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			// Mid-range colors with edges, so sharpening stays inside the gamut
+			v := 0.35 + 0.3*float64((x/4+y/3)%2)
+			setPixel(src, x, y, [4]float64{v * 65535, (0.3 + float64(x)/80) * 65535, (0.6 - float64(y)/80) * 65535, 65535})
+		}
+	}
+	spec := EffectSpec{Name: "S", Params: map[string]interface{}{"space": "lab", "channels": "L"}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	img := &Image{In: src, Out: NewBuffer(src, src.Bounds()), Bounds: src.Bounds()}
+	img.ApplyEffects([]EffectSpec{spec}, false, 0, 0)
+	lab := func(m Buffer, x int, y int) [3]float64 {
+		c := pixel(m, x, y)
+		return rgbToLab([3]float64{c[0] / 65535, c[1] / 65535, c[2] / 65535})
+	}
+	changed := false
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			before, after := lab(src, x, y), lab(img.Out, x, y)
+			changed = changed || math.Abs(after[0]-before[0]) > 0.01
+			if math.Abs(after[1]-before[1]) > 1e-4 || math.Abs(after[2]-before[2]) > 1e-4 {
+				t.Errorf("(%d, %d): Lab %v became %v", x, y, before, after)
+			}
+		}
+	}
+	if !changed {
+		t.Error("sharpening L changed nothing")
+	}
+}
+
+func TestHueKernelRejected(t *testing.T) {
+	for _, test := range []struct {
+		params map[string]interface{}
+		name   string
+		ok     bool
+	}{
+		{map[string]interface{}{"space": "hsv"}, "B", false}, // every channel by default
+		{map[string]interface{}{"space": "hsl", "channels": "S,H"}, "S", false},
+		{map[string]interface{}{"space": "hsv", "channels": "H"}, "U", false},
+		{map[string]interface{}{"space": "hsv", "channels": "S,V"}, "B", true},
+		{map[string]interface{}{"space": "hsl", "channels": "L,A"}, "E", true},
+		{map[string]interface{}{"space": "hsv", "channels": "H"}, "levels", true}, // a point operation
+		{map[string]interface{}{"space": "lab"}, "S", true},
+	} {
+		err := EffectSpec{Name: test.name, Params: test.params}.Validate()
+		if test.ok && err != nil {
+			t.Errorf("%s %v: %v", test.name, test.params, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s %v validated", test.name, test.params)
+		}
+	}
+}
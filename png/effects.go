@@ -3,8 +3,8 @@
 package png
 
 import (
+	"encoding/json"
 	"image"
-	"image/color"
 	"math"
 )
 
@@ -15,6 +15,73 @@ type Effects struct {
 	B [][]float64 // Blur kernel
 }
 
+// EffectSpec is a single entry of an effects list. In effects.txt an effect is
+// either a bare name ("S") or an object carrying parameters
+// ({"name": "U", "radius": 2, "amount": 1.5, "threshold": 0.02}).
+type EffectSpec struct {
+	Name   string
+	Params map[string]interface{}
+	Images map[string]Buffer // decoded image files named by parameters, see ImageFiles
+}
+
+// UnmarshalJSON accepts both the bare string form and the object form of an effect.
+func (spec *EffectSpec) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		spec.Name = name
+		spec.Params = nil
+		return nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	spec.Name, _ = fields["name"].(string)
+	delete(fields, "name")
+	spec.Params = nil
+	if len(fields) > 0 {
+		spec.Params = fields
+	}
+	return nil
+}
+
+// MarshalJSON writes the effect back in the shortest form that round-trips.
+func (spec EffectSpec) MarshalJSON() ([]byte, error) {
+	if len(spec.Params) == 0 {
+		return json.Marshal(spec.Name)
+	}
+	fields := map[string]interface{}{"name": spec.Name}
+	for k, v := range spec.Params {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// Float returns the numeric parameter key, or def if it was not given.
+func (spec EffectSpec) Float(key string, def float64) float64 {
+	if v, ok := spec.Params[key].(float64); ok {
+		return v
+	}
+	return def
+}
+
+// String returns the string parameter key, or def if it was not given.
+func (spec EffectSpec) String(key string, def string) string {
+	if v, ok := spec.Params[key].(string); ok {
+		return v
+	}
+	return def
+}
+
+// Specs wraps a list of bare effect names, as used before effects took parameters.
+func Specs(names ...string) []EffectSpec {
+	specs := make([]EffectSpec, len(names))
+	for i, name := range names {
+		specs[i] = EffectSpec{Name: name}
+	}
+	return specs
+}
+
 // Grayscale applies a grayscale filtering effect to the image
 func (img *Image) Grayscale(start int, end int) {
 	bounds := img.Out.Bounds()
@@ -28,104 +95,284 @@ func (img *Image) Grayscale(start int, end int) {
 			//Returns the pixel (i.e., RGBA) value at a (x,y) position
 			// Note: These get returned as int32 so based on the math you'll
 			// be performing you'll need to do a conversion to float64(..)
-			r, g, b, a := img.In.At(x, y).RGBA()
+			c := pixel(img.In, x, y)
 
 			//Note: The values for r,g,b,a for this assignment will range between [0, 65535].
 			//For certain computations (i.e., convolution) the values might fall outside this
 			// range so you need to clamp them between those values.
-			greyC := Clamp(float64(r+g+b) / 3)
+			greyC := (c[0] + c[1] + c[2]) / 3
 
-			//Note: The values need to be stored back as uint16 (I know weird..but there's valid reasons
-			// for this that I won't get into right now).
-			img.Out.Set(x, y, color.RGBA64{greyC, greyC, greyC, uint16(a)})
+			//Note: 16-bit buffers store the values back as uint16 (I know weird..but there's valid
+			// reasons for this that I won't get into right now), float buffers keep them as they are.
+			setPixel(img.Out, x, y, [4]float64{greyC, greyC, greyC, c[3]})
 		}
 	}
 }
 
 func NewEffects() Effects {
 	return Effects{
-		S: [][]float64{{0, -1, 0}, {-1, 5, -1}, {0, -1, 0}},
+		S: SharpenKernel(1),
 		E: [][]float64{{-1, -1, -1}, {-1, 8, -1}, {-1, -1, -1}},
 		B: [][]float64{{1.0 / 9, 1.0 / 9, 1.0 / 9}, {1.0 / 9, 1.0 / 9, 1.0 / 9}, {1.0 / 9, 1.0 / 9, 1.0 / 9}},
 	}
 }
 
-func (img *Image) ApplyEffects(effects []string, par bool, startY int, endY int) {
+// SharpenKernel returns the identity kernel plus strength times the 4-neighbour
+// Laplacian. A strength of 1 gives the classic 5-center sharpen used by "S".
+func SharpenKernel(strength float64) [][]float64 {
+	return [][]float64{
+		{0, -strength, 0},
+		{-strength, 1 + 4*strength, -strength},
+		{0, -strength, 0},
+	}
+}
+
+// GaussianKernel returns a normalized (2*radius+1)x(2*radius+1) gaussian kernel
+// with sigma = radius/2, the usual choice for unsharp masking.
+func GaussianKernel(radius int) [][]float64 {
+	if radius < 1 {
+		radius = 1
+	}
+	sigma := float64(radius) / 2
+	size := 2*radius + 1
+	kernel := make([][]float64, size)
+	var sum float64
+	for ky := 0; ky < size; ky++ {
+		kernel[ky] = make([]float64, size)
+		for kx := 0; kx < size; kx++ {
+			dx, dy := float64(kx-radius), float64(ky-radius)
+			kernel[ky][kx] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+			sum += kernel[ky][kx]
+		}
+	}
+	for ky := range kernel {
+		for kx := range kernel[ky] {
+			kernel[ky][kx] /= sum
+		}
+	}
+	return kernel
+}
+
+// ApplyEffects runs effects from In into Out. Out is scratch space: it and the
+// intermediate images after it go back to the buffer pools once the next pass has
+// read them. In is left as it was and never given back. With no effects, Out is In;
+// a nil Out is allocated when the first pass needs it.
+func (img *Image) ApplyEffects(effects []EffectSpec, par bool, startY int, endY int) {
 	e := NewEffects()
-	for i, effect := range effects {
+	in := img.In
+	done := func(m Buffer) {
+		if m != in && m != img.In && m != img.Out {
+			PutBuffer(m)
+		}
+	}
+	passes := Passes(effects)
+	if len(passes) == 0 {
+		if img.Out != in {
+			PutBuffer(img.Out)
+		}
+		img.Out = in
+		return
+	}
+	if img.Out == nil {
+		img.Out = NewBuffer(in, in.Bounds())
+	}
+	for i, pass := range passes {
 		if i > 0 {
+			prev := img.In
 			img.In = img.Out
-			img.Out = image.NewRGBA64(img.In.Bounds())
+			img.Out = NewBuffer(img.In, img.In.Bounds())
+			done(prev)
 		}
-		switch effect {
-		case "S": // Sharpen
+		out := img.Out
+		img.ApplyPass(pass, e, par, startY, endY)
+		// A transform leaves its result in a buffer of its own
+		done(out)
+	}
+	// The input of the last pass is done with too
+	last := img.In
+	img.In = in
+	done(last)
+}
+
+// Apply runs a single effect from In into Out. Unknown effect names copy In through.
+func (img *Image) Apply(effect EffectSpec, e Effects, par bool, startY int, endY int) {
+	if effect.Geometric() {
+		img.Transform(effect)
+		return
+	}
+	if effect.Global() {
+		stats := effect.NewStats(img.In.Bounds())
+		img.Accumulate(stats, img.In.Bounds().Min.Y, img.In.Bounds().Max.Y)
+		img.ApplyGlobal(effect, stats, par, startY, endY)
+		return
+	}
+	if effect.restricted() {
+		img.applyRestricted(effect, e, par, startY, endY)
+		return
+	}
+	if op, ok := effect.pointOp(img.Linear); ok {
+		start, end := img.rows(par, startY, endY)
+		img.applyPointOp(op, start, end)
+		return
+	}
+	switch effect.Name {
+	case "S": // Sharpen
+		if effect.Params == nil {
 			img.ApplyEffect(e.S, par, startY, endY)
-		case "E": // Edge Detection
-			img.ApplyEffect(e.E, par, startY, endY)
-		case "B": // Blurx
-			img.ApplyEffect(e.B, par, startY, endY)
-		case "G": // Grayscale
+		} else {
+			img.ApplyEffect(SharpenKernel(effect.Float("strength", 1)), par, startY, endY)
+		}
+	case "E": // Edge Detection
+		img.ApplyEffect(e.E, par, startY, endY)
+	case "B": // Blurx
+		img.ApplyEffect(e.B, par, startY, endY)
+	case "U": // Unsharp mask
+		img.UnsharpMask(int(effect.Float("radius", 1)), effect.Float("amount", 1), effect.Float("threshold", 0), par, startY, endY)
+	case "blend": // Composite a secondary image
+		start, end := img.rows(par, startY, endY)
+		img.Blend(effect, start, end)
+	case "G": // Grayscale
+		if par {
+			img.Grayscale(startY, endY)
+		} else {
 			img.Grayscale(0, 0)
-		default:
-			continue
 		}
+	default:
+		start, end := img.rows(par, startY, endY)
+		CopyRect(img.Out, image.Rect(img.In.Bounds().Min.X, start, img.In.Bounds().Max.X, end), img.In, image.Pt(img.In.Bounds().Min.X, start))
 	}
+}
 
+// Halo returns how many rows beyond its own an effect reads, i.e. how much
+// overlap a chunk needs with its neighbours for the effect to be exact.
+func (spec EffectSpec) Halo() int {
+	switch spec.Name {
+	case "S", "E", "B":
+		return 1
+	case "U":
+		r := int(spec.Float("radius", 1))
+		if r < 1 {
+			r = 1
+		}
+		return r
+	}
+	return 0
 }
 
-func (img *Image) ApplyEffect(kernel [][]float64, par bool, startY int, endY int) {
+// rows returns the rows an effect writes: the whole image, or in par mode only the
+// band [startY, endY) so that concurrent bands never write the same row.
+func (img *Image) rows(par bool, startY int, endY int) (int, int) {
 	bounds := img.In.Bounds()
-	kernelSize := 3
-	var start, end int
 	if !par {
-		start = bounds.Min.Y
-		end = bounds.Max.Y
-	} else {
-		start = int(math.Max(float64(startY-1), float64(0)))
-		end = int(math.Max(float64(endY+1), float64(bounds.Dy())))
+		return bounds.Min.Y, bounds.Max.Y
 	}
+	start := int(math.Max(float64(startY), float64(bounds.Min.Y)))
+	end := int(math.Min(float64(endY), float64(bounds.Max.Y)))
+	return start, end
+}
+
+func (img *Image) ApplyEffect(kernel [][]float64, par bool, startY int, endY int) {
+	start, end := img.rows(par, startY, endY)
+	convolve(img.In, img.Out, kernel, start, end, img.Premultiplied)
+}
+
+// convolve writes kernel*src into dst for rows [start, end), zero padding the
+// border. Alpha is convolved too if premultiplied is set, otherwise it is copied
+// from the center pixel. Kernels of fftKernelSize or more go through the FFT, and
+// smaller ones over float buffers through planar tiles.
+func convolve(src Buffer, dst Buffer, kernel [][]float64, start int, end int, premultiplied bool) {
+	if len(kernel) >= fftKernelSize(src) {
+		convolveFFT(src, dst, kernel, start, end, premultiplied)
+		return
+	}
+	if _, ok := src.(*Float); ok {
+		convolveTiled(src, dst, kernel, start, end, premultiplied)
+		return
+	}
+	convolveDirect(src, dst, kernel, start, end, premultiplied)
+}
+
+// convolveDirect is convolve summing every kernel tap per pixel in float64, which
+// 16-bit buffers keep to: Clamp truncates, so a whole-number sum that float32
+// left a little short would come out a step lower.
+func convolveDirect(src Buffer, dst Buffer, kernel [][]float64, start int, end int, premultiplied bool) {
+	bounds := src.Bounds()
+	kernelSize := len(kernel)
+	offset := kernelSize / 2
 	for y := start; y < end; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			var r, g, b, _ uint32
-			var sumR, sumG, sumB float64
+			var sum [4]float64
 
 			for ky := 0; ky < kernelSize; ky++ {
 				for kx := 0; kx < kernelSize; kx++ {
-					pxX := x + kx - 1
-					pxY := y + ky - 1
-					// Apply zero padding for pixels outside the bounds
-					if pxX < 0 || pxY < 0 {
-						r, g, b = 0, 0, 0
-					} else {
-						r, g, b, _ = img.In.At(pxX, pxY).RGBA()
-					}
+					// Pixels outside the bounds read as zero
+					c := pixel(src, x+kx-offset, y+ky-offset)
 
 					// Apply kernel
-					sumR += kernel[ky][kx] * float64(r)
-					sumG += kernel[ky][kx] * float64(g)
-					sumB += kernel[ky][kx] * float64(b)
+					for ch := range sum {
+						sum[ch] += kernel[ky][kx] * c[ch]
+					}
 				}
 			}
 
-			// Clamp the summed values, scale back up to [0, 65535], and convert back to uint16
-			newR := Clamp(sumR)
-			newG := Clamp(sumG)
-			newB := Clamp(sumB)
-
-			_, _, _, a := img.In.At(x, y).RGBA()
-			img.Out.Set(x, y, color.RGBA64{R: newR, G: newG, B: newB, A: uint16(a)})
+			if premultiplied {
+				setPixel(dst, x, y, premultipliedColor(dst, sum))
+				continue
+			}
+			sum[3] = pixel(src, x, y)[3]
+			setPixel(dst, x, y, sum)
 		}
 	}
 }
 
-func (img *Image) MakeChunk(startY int, endY int) *Image {
+// premultipliedColor keeps a filtered color valid for 16-bit premultiplied storage,
+// where no channel may exceed alpha. Float buffers leave that to output.
+func premultipliedColor(m Buffer, c [4]float64) [4]float64 {
+	if _, ok := m.(*Float); ok {
+		return c
+	}
+	for ch := 0; ch < 3; ch++ {
+		c[ch] = math.Min(c[ch], c[3])
+	}
+	return c
+}
+
+// UnsharpMask sharpens by adding amount times the difference between the image
+// and a gaussian blur of the given radius. Differences smaller than threshold
+// (a fraction of full scale, 0..1) are left alone so flat noisy areas are not boosted.
+func (img *Image) UnsharpMask(radius int, amount float64, threshold float64, par bool, startY int, endY int) {
+	kernel := GaussianKernel(radius)
+	start, end := img.rows(par, startY, endY)
+	blurred := NewBuffer(img.In, img.In.Bounds())
+	defer PutBuffer(blurred)
+	convolve(img.In, blurred, kernel, start, end, img.Premultiplied)
+
+	limit := threshold * 65535
+	sharpen := func(orig, blur float64) float64 {
+		diff := orig - blur
+		if math.Abs(diff) <= limit {
+			return orig
+		}
+		return orig + amount*diff
+	}
 	bounds := img.In.Bounds()
-	chunk := image.NewRGBA64(image.Rect(bounds.Min.X, startY, bounds.Max.X, endY))
-	for y := startY; y < endY; y++ {
+	for y := start; y < end; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := img.In.At(x, y).RGBA()
-			chunk.Set(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+			orig := pixel(img.In, x, y)
+			blur := pixel(blurred, x, y)
+			c := [4]float64{sharpen(orig[0], blur[0]), sharpen(orig[1], blur[1]), sharpen(orig[2], blur[2]), orig[3]}
+			if img.Premultiplied {
+				c[3] = sharpen(orig[3], blur[3])
+				c = premultipliedColor(img.Out, c)
+			}
+			setPixel(img.Out, x, y, c)
 		}
 	}
-	return &Image{In: chunk, Out: chunk, Bounds: chunk.Bounds()}
+}
+
+func (img *Image) MakeChunk(startY int, endY int) *Image {
+	bounds := img.In.Bounds()
+	chunk := NewBuffer(img.In, image.Rect(bounds.Min.X, startY, bounds.Max.X, endY))
+	CopyRect(chunk, chunk.Bounds(), img.In, chunk.Bounds().Min)
+	return &Image{In: chunk, Out: NewBuffer(chunk, chunk.Bounds()), Bounds: chunk.Bounds(), Premultiplied: img.Premultiplied, Linear: img.Linear}
 }
@@ -0,0 +1,138 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	exifHeader         = "Exif\x00\x00"
+	orientationTag     = 0x0112
+	maxJPEGSegmentData = 0xffff - 2
+)
+
+// readExif returns the EXIF block of an encoded JPEG (its APP1 segment) or PNG
+// (its eXIf chunk), starting at the TIFF header. Other formats have none.
+func readExif(data []byte) []byte {
+	var exif []byte
+	walkChunks(data, func(typ string, body []byte) {
+		if typ == "eXIf" && exif == nil {
+			exif = append([]byte(nil), body...)
+		}
+	})
+	if exif != nil || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return exif
+	}
+	// JPEG segments up to the start of the scan
+	for rest := data[2:]; len(rest) >= 4 && rest[0] == 0xff; {
+		marker := rest[1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(rest[2:]))
+		if length < 2 || length+2 > len(rest) {
+			break
+		}
+		body := rest[4 : 2+length]
+		if marker == 0xe1 && bytes.HasPrefix(body, []byte(exifHeader)) {
+			return append([]byte(nil), body[len(exifHeader):]...)
+		}
+		rest = rest[2+length:]
+	}
+	return nil
+}
+
+// orientationEntry finds the Orientation tag in the first IFD of an EXIF block and
+// returns the byte order and the offset of its value, or -1 if there is none.
+func orientationEntry(exif []byte) (binary.ByteOrder, int) {
+	if len(exif) < 8 {
+		return nil, -1
+	}
+	var order binary.ByteOrder
+	switch string(exif[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, -1
+	}
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return nil, -1
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(exif) {
+			break
+		}
+		// a SHORT with one value, stored in the first two bytes of the value field
+		if order.Uint16(exif[entry:]) == orientationTag && order.Uint16(exif[entry+2:]) == 3 {
+			return order, entry + 8
+		}
+	}
+	return nil, -1
+}
+
+// Orientation returns the EXIF orientation of the source, 1 through 8, where 1
+// means the pixels are already upright. Images without one report 1.
+func (img *Image) Orientation() int {
+	order, offset := orientationEntry(img.Exif)
+	if offset < 0 {
+		return 1
+	}
+	if o := int(order.Uint16(img.Exif[offset:])); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// AutoOrient turns In upright according to the EXIF orientation and marks the
+// EXIF block as upright to match, so viewers don't rotate the output again. It
+// should run before any effect; Out is replaced by an empty image of the new size.
+func (img *Image) AutoOrient() {
+	var out Buffer
+	switch img.Orientation() {
+	case 2:
+		out = FlipH(img.In)
+	case 3:
+		out = Rotate(img.In, 180)
+	case 4:
+		out = FlipV(img.In)
+	case 5:
+		out = FlipH(Rotate(img.In, 270))
+	case 6:
+		out = Rotate(img.In, 270)
+	case 7:
+		out = FlipH(Rotate(img.In, 90))
+	case 8:
+		out = Rotate(img.In, 90)
+	default:
+		return
+	}
+	img.In = out
+	img.Out = NewBuffer(out, out.Bounds())
+	img.Bounds = out.Bounds()
+	img.Exif = append([]byte(nil), img.Exif...)
+	order, offset := orientationEntry(img.Exif)
+	order.PutUint16(img.Exif[offset:], 1)
+}
+
+// writeExif copies an encoded JPEG to w with exif stored in an APP1 segment right
+// after the start-of-image marker.
+func writeExif(w io.Writer, encoded []byte, exif []byte) error {
+	if len(exif)+len(exifHeader) > maxJPEGSegmentData {
+		return fmt.Errorf("exif block of %d bytes doesn't fit in a jpeg segment", len(exif))
+	}
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(exifHeader)+len(exif)))
+	for _, part := range [][]byte{encoded[:2], segment, []byte(exifHeader), exif, encoded[2:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
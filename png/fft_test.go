@@ -0,0 +1,124 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// noise returns a w×h buffer of uneven colors under three levels of alpha, as a
+// float buffer if float is set.
+func noise(w int, h int, float bool) Buffer {
+	m := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint16(65535 - (x/9+y/7)%3*23130)
+			m.SetRGBA64(x, y, color.RGBA64{uint16(x*997+y*31) % a, uint16(y*1231) % a, uint16(x*y*7) % a, a})
+		}
+	}
+	if !float {
+		return m
+	}
+	f := NewFloat(m.Rect)
+	CopyRect(f, m.Rect, m, m.Rect.Min)
+	return f
+}
+
+// TestConvolveFFT checks the FFT against direct sums within the bounds fftKernelSize
+// documents: float32 rounding for float buffers, one step for 16-bit ones.
+func TestConvolveFFT(t *testing.T) {
+	for _, float := range []bool{false, true} {
+		src := noise(97, 61, float)
+		b := src.Bounds()
+		for _, radius := range []int{1, 2, 3, 5, 10} {
+			kernel := GaussianKernel(radius)
+			for _, premultiplied := range []bool{false, true} {
+				direct, fft := NewBuffer(src, b), NewBuffer(src, b)
+				convolveDirect(src, direct, kernel, b.Min.Y, b.Max.Y, premultiplied)
+				convolveFFT(src, fft, kernel, b.Min.Y, b.Max.Y, premultiplied)
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						want, got := pixel(direct, x, y), pixel(fft, x, y)
+						for c := range want {
+							tolerance := 1.0
+							if float {
+								tolerance = 1e-9*65535 + math.Abs(want[c])/(1<<23)
+							}
+							if math.Abs(got[c]-want[c]) > tolerance {
+								t.Fatalf("float %v, radius %d, premultiplied %v: (%d, %d) channel %d is %v through the FFT, %v summed directly",
+									float, radius, premultiplied, x, y, c, got[c], want[c])
+							}
+						}
+					}
+				}
+				PutBuffer(direct)
+				PutBuffer(fft)
+			}
+		}
+	}
+}
+
+// TestConvolveFFTMargin pins fftMargin: whole-number sums come out whole rather
+// than a step low, and so the same however the rows are split into chunks.
+func TestConvolveFFTMargin(t *testing.T) {
+	kernel := GaussianKernel(3)
+	flat := image.NewRGBA64(image.Rect(0, 0, 80, 60))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0x80
+	}
+	// Away from the zero padded border the blur of a flat image is the image
+	inner := flat.Rect.Inset(3)
+	out := image.NewRGBA64(flat.Rect)
+	convolveFFT(flat, out, kernel, flat.Rect.Min.Y, flat.Rect.Max.Y, true)
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			if got, want := out.RGBA64At(x, y), flat.RGBA64At(x, y); got != want {
+				t.Fatalf("(%d, %d) of a flat image is %v after the FFT blur, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	src := noise(300, 200, false).(*image.RGBA64)
+	whole, chunked := image.NewRGBA64(src.Rect), image.NewRGBA64(src.Rect)
+	convolveFFT(src, whole, kernel, 0, 200, false)
+	for _, rows := range [][2]int{{0, 66}, {66, 133}, {133, 200}} {
+		convolveFFT(src, chunked, kernel, rows[0], rows[1], false)
+	}
+	for i := range whole.Pix {
+		if whole.Pix[i] != chunked.Pix[i] {
+			t.Fatalf("the FFT blur in three chunks differs from the whole image's at byte %d", i)
+		}
+	}
+}
+
+// BenchmarkConvolve times the FFT against the path convolve takes below
+// fftKernelSize for each kernel size, to show where they cross over.
+func BenchmarkConvolve(b *testing.B) {
+	for _, float := range []bool{false, true} {
+		src := noise(1024, 768, float)
+		dst := NewBuffer(src, src.Bounds())
+		kind := "rgba64"
+		if float {
+			kind = "float32"
+		}
+		for _, radius := range []int{1, 2, 3, 4, 5, 7, 9, 10} {
+			kernel := GaussianKernel(radius)
+			for _, fft := range []bool{false, true} {
+				run, name := convolveDirect, "direct"
+				if float {
+					run, name = convolveTiled, "tiled"
+				}
+				if fft {
+					run, name = convolveFFT, "fft"
+				}
+				b.Run(fmt.Sprintf("%s/%dx%d/%s", kind, len(kernel), len(kernel), name), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						run(src, dst, kernel, 0, 768, false)
+					}
+				})
+			}
+		}
+	}
+}
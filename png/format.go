@@ -0,0 +1,146 @@
+package png
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+
+	// Register the decoders image.Decode can pick from
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// SaveOptions controls how an Image is encoded. The zero value writes the format
+// implied by the file extension with default encoder settings, from 16-bit RGBA.
+// Still PNG and BMP output omits alpha for opaque images on its own; APNG keeps the
+// channel unless DropAlpha is set.
+type SaveOptions struct {
+	Format      string `json:"format"`      // "png", "jpeg", "gif", "bmp" or "tiff"; empty picks by extension
+	Quality     int    `json:"quality"`     // JPEG quality 1-100, 0 for the encoder default
+	Depth       string `json:"depth"`       // "source" to match the decoded image, "8" or "16"; empty means 16
+	Gray        bool   `json:"gray"`        // write a single gray channel
+	DropAlpha   bool   `json:"dropAlpha"`   // write no alpha channel when every pixel is opaque
+	Compression string `json:"compression"` // PNG compression: "default", "none", "speed" or "best"
+
+	// PNG metadata. The source's text, color and resolution chunks are kept unless
+	// stripped here.
+	StripMetadata []string          `json:"stripMetadata"` // chunk types to drop, e.g. "iCCP", or "all"
+	Text          map[string]string `json:"text"`          // text entries to add or replace, by keyword
+	DPI           float64           `json:"dpi"`           // resolution to record instead of the source's
+
+	// StripExif drops the source's EXIF block, which is otherwise written to JPEG
+	// output as APP1 and to PNG output as an eXIf chunk.
+	StripExif bool `json:"stripExif"`
+}
+
+// compressionLevels maps SaveOptions.Compression to the PNG encoder setting.
+var compressionLevels = map[string]png.CompressionLevel{
+	"":        png.DefaultCompression,
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// FormatFor returns the output format for a file path: the explicit format if one
+// is given, otherwise the one its extension names.
+func FormatFor(filePath string, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filePath)), ".")
+	}
+	switch format {
+	case "png", "gif", "bmp":
+		return format, nil
+	case "jpg", "jpeg":
+		return "jpeg", nil
+	case "tif", "tiff":
+		return "tiff", nil
+	case "webp":
+		return "", fmt.Errorf("webp can be read but not written")
+	}
+	return "", fmt.Errorf("unknown output format %q", format)
+}
+
+// output converts Out to the bit depth and color model the options ask for. The
+// result may be borrowed from the buffer pools; release gives it back.
+func (img *Image) output(opts SaveOptions) (image.Image, error) {
+	depth, gray := opts.Depth, opts.Gray
+	if depth == "source" {
+		depth = "16"
+		switch img.ColorModel {
+		case color.GrayModel:
+			depth, gray = "8", true
+		case color.Gray16Model:
+			gray = true
+		case color.RGBA64Model, color.NRGBA64Model, nil:
+		default:
+			depth = "8"
+		}
+	}
+	out := img.rgba64()
+	bounds := out.Bounds()
+	var dst draw.Image
+	switch {
+	case gray && depth == "8":
+		dst = image.NewGray(bounds)
+	case gray && (depth == "16" || depth == ""):
+		dst = image.NewGray16(bounds)
+	case depth == "8":
+		dst = image.NewNRGBA(bounds)
+	case depth == "16" || depth == "":
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown output depth %q", opts.Depth)
+	}
+	draw.Draw(dst, bounds, out, bounds.Min, draw.Src)
+	img.release(out)
+	return dst, nil
+}
+
+// opaque reports whether every pixel of b is fully opaque once rounded to 16 bits.
+func opaque(b Buffer) bool {
+	if m, ok := b.(*image.RGBA64); ok {
+		return m.Opaque()
+	}
+	bounds := b.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if pixel(b, x, y)[3] < 65534.5 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// encode writes m to w in the given format, which must come from FormatFor.
+func encode(w io.Writer, m image.Image, format string, opts SaveOptions) error {
+	switch format {
+	case "jpeg":
+		quality := opts.Quality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, m, &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg})
+	case "bmp":
+		return bmp.Encode(w, m)
+	case "tiff":
+		return tiff.Encode(w, m, &tiff.Options{Compression: tiff.Deflate})
+	}
+	level, ok := compressionLevels[opts.Compression]
+	if !ok {
+		return fmt.Errorf("unknown png compression %q", opts.Compression)
+	}
+	encoder := png.Encoder{CompressionLevel: level}
+	return encoder.Encode(w, m)
+}
@@ -0,0 +1,78 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// TestDropAlpha checks the color type APNG output is written in: RGB when every
+// frame is opaque and DropAlpha is set, RGBA otherwise.
+func TestDropAlpha(t *testing.T) {
+	frame := func(alpha uint16, float bool) Frame {
+		m := image.NewRGBA64(image.Rect(0, 0, 4, 3))
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 4; x++ {
+				m.SetRGBA64(x, y, color.RGBA64{uint16(x) * 10000, uint16(y) * 20000, 0, 65535})
+			}
+		}
+		m.SetRGBA64(3, 2, color.RGBA64{alpha, alpha, alpha, alpha})
+		var out Buffer = m
+		if float {
+			out = NewFloat(m.Rect)
+			CopyRect(out, m.Rect, m, m.Rect.Min)
+		}
+		return Frame{Image: &Image{Out: out, Bounds: m.Rect}, Delay: 100 * time.Millisecond}
+	}
+	for _, test := range []struct {
+		opts      SaveOptions
+		secondA   uint16 // alpha of one pixel of the second frame
+		colorType byte
+	}{
+		{SaveOptions{}, 65535, 6},
+		{SaveOptions{DropAlpha: true}, 65535, 2},
+		{SaveOptions{DropAlpha: true}, 30000, 6}, // one translucent pixel keeps it
+		{SaveOptions{DropAlpha: true, Depth: "8"}, 65535, 2},
+		{SaveOptions{DropAlpha: true, Gray: true}, 65535, 0},
+	} {
+		for _, float := range []bool{false, true} {
+			anim := &Animation{Frames: []Frame{frame(65535, float), frame(test.secondA, float)}}
+			var buf bytes.Buffer
+			if err := anim.Encode(&buf, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			// The color type is the tenth byte of IHDR, the first chunk
+			if ct := buf.Bytes()[8+8+9]; ct != test.colorType {
+				t.Errorf("%+v, alpha %d, float %v: color type %d, want %d", test.opts, test.secondA, float, ct, test.colorType)
+			}
+			decoded, err := DecodeAnimation(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded.Frames) != 2 {
+				t.Fatalf("%+v: decoded %d frames", test.opts, len(decoded.Frames))
+			}
+			if test.opts.Gray || test.opts.Depth != "" {
+				continue
+			}
+			// 16-bit color comes back exactly, with or without the alpha channel
+			for i, f := range decoded.Frames {
+				src := anim.Frames[i].Image.rgba64()
+				want := src.RGBA64At(1, 2)
+				anim.Frames[i].Image.release(src)
+				if got := color.RGBA64Model.Convert(f.Image.In.At(1, 2)); got != want {
+					t.Errorf("%+v, float %v: frame %d (1, 2) is %v, want %v", test.opts, float, i, got, want)
+				}
+			}
+		}
+	}
+
+	if err := (SaveOptions{DropAlpha: true}).Validate("out.tiff"); err == nil {
+		t.Error("tiff output validated with dropAlpha")
+	}
+	if err := (SaveOptions{DropAlpha: true, Gray: true}).Validate("out.tiff"); err != nil {
+		t.Errorf("gray tiff output with dropAlpha: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package png
+
+import (
+	"image"
+	"math"
+)
+
+// Stats holds channel value histograms over a grid of tiles laid on an image.
+// Global effects ("equalize", "levels" with auto) use a single tile, "clahe" one
+// per tile. R, G and B all count towards the same histogram.
+//
+// Stats can be accumulated over any split of the image rows and merged, which is
+// how the chunked scheduler computes them: every chunk accumulates its own rows
+// in parallel, the partial results are merged, and the merged Stats are then used
+// to map each chunk.
+type Stats struct {
+	Bounds image.Rectangle
+	TileW  int
+	TileH  int
+	Cols   int
+	Rows   int
+	Levels int     // number of bins per histogram
+	Bins   [][]int // one histogram per tile, row major
+}
+
+// NewStats returns empty statistics laid out the way the effect needs them over bounds.
+func (spec EffectSpec) NewStats(bounds image.Rectangle) *Stats {
+	tileW, tileH, levels := bounds.Dx(), bounds.Dy(), 65536
+	if spec.Name == "clahe" {
+		tile := int(spec.Float("tileSize", 64))
+		if tile < 1 {
+			tile = 1
+		}
+		tileW, tileH, levels = tile, tile, 4096
+	}
+	if tileW < 1 {
+		tileW = 1
+	}
+	if tileH < 1 {
+		tileH = 1
+	}
+	stats := &Stats{
+		Bounds: bounds,
+		TileW:  tileW,
+		TileH:  tileH,
+		Cols:   (bounds.Dx() + tileW - 1) / tileW,
+		Rows:   (bounds.Dy() + tileH - 1) / tileH,
+		Levels: levels,
+	}
+	stats.Bins = make([][]int, stats.Cols*stats.Rows)
+	for i := range stats.Bins {
+		stats.Bins[i] = make([]int, levels)
+	}
+	return stats
+}
+
+// bin returns the histogram bin of a channel value.
+func (stats *Stats) bin(v float64) int {
+	return int(Clamp(v)) * stats.Levels / 65536
+}
+
+// Accumulate adds the pixels of rows [startY, endY) of In to stats.
+func (img *Image) Accumulate(stats *Stats, startY int, endY int) {
+	bounds := img.In.Bounds()
+	for y := startY; y < endY; y++ {
+		row := (y - bounds.Min.Y) / stats.TileH
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			hist := stats.Bins[row*stats.Cols+(x-bounds.Min.X)/stats.TileW]
+			c := pixel(img.In, x, y)
+			hist[stats.bin(c[0])]++
+			hist[stats.bin(c[1])]++
+			hist[stats.bin(c[2])]++
+		}
+	}
+}
+
+// Merge adds other, accumulated over different rows of the same image, into stats.
+func (stats *Stats) Merge(other *Stats) {
+	for t := range stats.Bins {
+		for i, n := range other.Bins[t] {
+			stats.Bins[t][i] += n
+		}
+	}
+}
+
+// ApplyGlobal maps rows of In into Out using statistics of the whole image.
+func (img *Image) ApplyGlobal(effect EffectSpec, stats *Stats, par bool, startY int, endY int) {
+	start, end := img.rows(par, startY, endY)
+	switch effect.Name {
+	case "levels":
+		black, white := clipRange(stats.Bins[0], effect.Float("clip", 0.005))
+		img.applyPointOp(levels(float64(black)/65535, float64(white)/65535, 1), start, end)
+	case "equalize":
+		lut := equalize(stats.Bins[0], -1)
+		img.applyPointOp(func(r, g, b float64) (float64, float64, float64) {
+			return lut[Clamp(r*65535)], lut[Clamp(g*65535)], lut[Clamp(b*65535)]
+		}, start, end)
+	case "clahe":
+		img.clahe(stats, effect.Float("clipLimit", 2), start, end)
+	}
+	if weight := effect.mask(); weight != nil {
+		img.blendMask(weight, start, end)
+	}
+}
+
+// clipRange returns the channel values below and above which a clip fraction of
+// the histogram lies.
+func clipRange(hist []int, clip float64) (int, int) {
+	total := 0
+	for _, n := range hist {
+		total += n
+	}
+	limit := int(clip * float64(total))
+	black, white := 0, len(hist)-1
+	for count := 0; black < len(hist)-1 && count+hist[black] <= limit; black++ {
+		count += hist[black]
+	}
+	for count := 0; white > 0 && count+hist[white] <= limit; white-- {
+		count += hist[white]
+	}
+	return black, white
+}
+
+// equalize returns the normalized (0..1) output level for every bin. When clip is
+// positive, bins are capped at clip times the mean bin count and the excess is
+// spread evenly over all bins first, as in CLAHE.
+func equalize(hist []int, clip float64) []float64 {
+	counts := make([]float64, len(hist))
+	total := 0.0
+	for i, n := range hist {
+		counts[i] = float64(n)
+		total += float64(n)
+	}
+	if clip > 0 && total > 0 {
+		limit := math.Max(1, clip*total/float64(len(hist)))
+		excess := 0.0
+		for i := range counts {
+			if counts[i] > limit {
+				excess += counts[i] - limit
+				counts[i] = limit
+			}
+		}
+		for i := range counts {
+			counts[i] += excess / float64(len(counts))
+		}
+	}
+	lut := make([]float64, len(hist))
+	cdf, first := 0.0, -1.0
+	for i, n := range counts {
+		cdf += n
+		if first < 0 && n > 0 {
+			first = cdf
+		}
+		if total-first > 0 {
+			lut[i] = math.Max(0, (cdf-first)/(total-first))
+		}
+	}
+	return lut
+}
+
+// clahe maps rows [start, end) by interpolating bilinearly between the equalization
+// curves of the four tiles whose centers surround each pixel.
+func (img *Image) clahe(stats *Stats, clipLimit float64, start int, end int) {
+	luts := make([][]float64, len(stats.Bins))
+	for t, hist := range stats.Bins {
+		luts[t] = equalize(hist, clipLimit)
+	}
+	// tile returns the neighbouring tile index and the weight of the second one along an axis
+	tile := func(p int, size int, count int) (int, int, float64) {
+		f := (float64(p)+0.5)/float64(size) - 0.5
+		i0 := int(math.Floor(f))
+		w := f - float64(i0)
+		i1 := i0 + 1
+		if i0 < 0 {
+			i0, w = 0, 0
+		}
+		if i1 > count-1 {
+			i1 = count - 1
+		}
+		if i0 > count-1 {
+			i0 = count - 1
+		}
+		return i0, i1, w
+	}
+	bounds := img.In.Bounds()
+	for y := start; y < end; y++ {
+		r0, r1, wy := tile(y-bounds.Min.Y, stats.TileH, stats.Rows)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c0, c1, wx := tile(x-bounds.Min.X, stats.TileW, stats.Cols)
+			mapValue := func(v float64) float64 {
+				b := stats.bin(v)
+				top := (1-wx)*luts[r0*stats.Cols+c0][b] + wx*luts[r0*stats.Cols+c1][b]
+				bottom := (1-wx)*luts[r1*stats.Cols+c0][b] + wx*luts[r1*stats.Cols+c1][b]
+				return ((1-wy)*top + wy*bottom) * 65535
+			}
+			c := pixel(img.In, x, y)
+			setPixel(img.Out, x, y, [4]float64{mapValue(c[0]), mapValue(c[1]), mapValue(c[2]), c[3]})
+		}
+	}
+}
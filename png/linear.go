@@ -0,0 +1,96 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// srgbToLinear decodes a normalized sRGB value to linear light.
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB encodes a normalized linear light value to sRGB.
+func linearToSRGB(c float64) float64 {
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+// Linearize converts In from sRGB to linear light in float32 buffers, so blurs and
+// resampling average physical intensities instead of gamma-encoded values, which
+// darkens them. Every effect after it runs in linear light, and output encodes the
+// result back to sRGB. It should run before any effect.
+func (img *Image) Linearize() {
+	if img.Linear {
+		return
+	}
+	img.UseFloat()
+	bounds := img.In.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := pixel(img.In, x, y)
+			// The transfer function applies to unpremultiplied colors
+			if a := c[3]; a > 0 {
+				for ch := 0; ch < 3; ch++ {
+					c[ch] = srgbToLinear(c[ch]/a) * a
+				}
+			}
+			setPixel(img.In, x, y, c)
+		}
+	}
+	img.Linear = true
+}
+
+// UseFloat moves In into a float32 buffer, so the effects that follow keep their
+// full precision and out of range values from one effect to the next. Clamping
+// and rounding to 16 bits happen once, on output.
+func (img *Image) UseFloat() {
+	if _, ok := img.In.(*Float); ok {
+		return
+	}
+	bounds := img.In.Bounds()
+	in := NewFloat(bounds)
+	CopyRect(in, bounds, img.In, bounds.Min)
+	img.In = in
+	img.Out = NewFloat(bounds)
+}
+
+// rgba64 returns Out as 16-bit pixels: float buffers are clamped and rounded, and
+// linear light is encoded back to sRGB.
+func (img *Image) rgba64() *image.RGBA64 {
+	if m, ok := img.Out.(*image.RGBA64); ok && !img.Linear {
+		return m
+	}
+	bounds := img.Out.Bounds()
+	dst := newRGBA64(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := pixel(img.Out, x, y)
+			a := math.Min(1, math.Max(0, c[3]/65535))
+			var rgb [3]float64
+			for ch := range rgb {
+				v := math.Min(a, math.Max(0, c[ch]/65535))
+				if img.Linear && a > 0 {
+					v = linearToSRGB(v/a) * a
+				}
+				rgb[ch] = v
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{quantize(rgb[0], 1), quantize(rgb[1], 1), quantize(rgb[2], 1), quantize(a, 1)})
+		}
+	}
+	return dst
+}
+
+// release gives m back to the buffer pools if rgba64 or output made it for
+// encoding, rather than it being Out itself.
+func (img *Image) release(m image.Image) {
+	if m, ok := m.(*image.RGBA64); ok && m != img.Out {
+		PutBuffer(m)
+	}
+}
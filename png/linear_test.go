@@ -0,0 +1,128 @@
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	stdpng "image/png"
+	"testing"
+)
+
+// decodeTest runs m through the PNG encoder and Decode, as a task's input would.
+func decodeTest(t *testing.T, m image.Image) *Image {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := stdpng.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// encode8 returns Out as it is saved at 8 bits.
+func encode8(t *testing.T, img *Image) *image.NRGBA {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := img.Encode(&buf, SaveOptions{Depth: "8"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := stdpng.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := image.NewNRGBA(m.Bounds())
+	draw.Draw(out, out.Rect, m, m.Bounds().Min, draw.Src)
+	return out
+}
+
+func TestLinearAverage(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	m.Set(0, 0, color.NRGBA{0, 0, 0, 255})
+	m.Set(1, 0, color.NRGBA{255, 255, 255, 255})
+	shrink := []EffectSpec{{Name: "resize", Params: map[string]interface{}{"width": 1.0, "height": 1.0}}}
+	for _, c := range []struct {
+		linear bool
+		want   uint8
+	}{{false, 127}, {true, 188}} {
+		img := decodeTest(t, m)
+		if c.linear {
+			img.Linearize()
+		}
+		img.ApplyEffects(shrink, false, 0, 0)
+		if got := encode8(t, img).NRGBAAt(0, 0); got.R != c.want || got.G != c.want || got.B != c.want {
+			t.Errorf("linear %v: black and white average to %v, want %d", c.linear, got, c.want)
+		}
+	}
+}
+
+func TestLinearRoundTrip(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 256, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 256; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x), uint8(255 - x), uint8(x * 7), 255})
+		}
+	}
+	img := decodeTest(t, m)
+	img.Linearize()
+	img.ApplyEffects(nil, false, 0, 0)
+	out := encode8(t, img)
+	if !bytes.Equal(out.Pix, m.Pix) {
+		for i := range out.Pix {
+			if out.Pix[i] != m.Pix[i] {
+				t.Fatalf("byte %d came back as %d, was %d", i, out.Pix[i], m.Pix[i])
+			}
+		}
+	}
+}
+
+// gradient returns a w x h test image with varying colors and alpha.
+func gradient(w int, h int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8(x * y), uint8(255 - (x+y)%3*60)})
+		}
+	}
+	return m
+}
+
+func TestLinearChunks(t *testing.T) {
+	effects := []EffectSpec{
+		{Name: "brightness", Params: map[string]interface{}{"amount": 0.2, "channels": "L", "space": "lab"}},
+		{Name: "B"},
+		{Name: "S"},
+	}
+	whole := decodeTest(t, gradient(40, 30))
+	whole.Linearize()
+	whole.Out = NewBuffer(whole.In, whole.In.Bounds())
+	whole.ApplyEffects(effects, false, 0, 0)
+
+	chunked := decodeTest(t, gradient(40, 30))
+	chunked.Linearize()
+	out := NewBuffer(chunked.In, chunked.In.Bounds())
+	pad := 0
+	for _, effect := range effects {
+		pad += effect.Halo()
+	}
+	bounds := chunked.In.Bounds()
+	for start := 0; start < bounds.Max.Y; start += 7 {
+		end := start + 7
+		if end > bounds.Max.Y {
+			end = bounds.Max.Y
+		}
+		chunk := chunked.MakeChunk(max(start-pad, 0), min(end+pad, bounds.Max.Y))
+		chunk.ApplyEffects(effects, false, 0, 0)
+		r := image.Rect(bounds.Min.X, start, bounds.Max.X, end)
+		CopyRect(out, r, chunk.Out, r.Min)
+	}
+	got, want := out.(*Float), whole.Out.(*Float)
+	for i := range want.Pix {
+		if got.Pix[i] != want.Pix[i] {
+			t.Fatalf("chunked output differs from whole-image output at %d: %v, want %v", i, got.Pix[i], want.Pix[i])
+		}
+	}
+}
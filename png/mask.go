@@ -0,0 +1,184 @@
+package png
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Any effect that keeps the image bounds can be restricted with parameters:
+//
+//	"channels": "R,B"    only the listed channels of its color space change, and
+//	                     "A" runs the effect on alpha as if it were a gray image
+//	"space": "lab"       the color space the channels are taken from, see convert
+//	"mask": {...}        the result is blended with the input by the mask value
+//
+// A mask is a rectangle ({"x", "y", "width", "height"}), a polygon
+// ({"points": [[x, y], ...]}) or the name of a grayscale image file whose pixels
+// line up with the image's. Global effects accept a mask but not channels.
+
+// restricted reports whether the effect applies to only some channels or pixels.
+func (spec EffectSpec) restricted() bool {
+	return spec.Params["space"] != nil || spec.Params["channels"] != nil || spec.Params["mask"] != nil
+}
+
+// without returns a copy of the effect minus the given parameters.
+func (spec EffectSpec) without(keys ...string) EffectSpec {
+	out := EffectSpec{Name: spec.Name, Images: spec.Images}
+	for k, v := range spec.Params {
+		drop := false
+		for _, key := range keys {
+			drop = drop || k == key
+		}
+		if !drop {
+			if out.Params == nil {
+				out.Params = make(map[string]interface{})
+			}
+			out.Params[k] = v
+		}
+	}
+	return out
+}
+
+// applyRestricted runs an effect limited by its channels and mask parameters.
+func (img *Image) applyRestricted(effect EffectSpec, e Effects, par bool, startY int, endY int) {
+	inner := effect.without("space", "channels", "mask")
+	if effect.Params["space"] != nil || effect.Params["channels"] != nil {
+		img.applyInSpace(inner, effect.String("space", "rgb"), effect.String("channels", ""), e, par, startY, endY)
+	} else {
+		img.Apply(inner, e, par, startY, endY)
+	}
+	if weight := effect.mask(); weight != nil {
+		start, end := img.rows(par, startY, endY)
+		img.blendMask(weight, start, end)
+	}
+}
+
+// blendMask mixes rows [start, end) of Out back towards In where the mask weight
+// is below 1.
+func (img *Image) blendMask(weight func(x, y int) float64, start int, end int) {
+	bounds := img.In.Bounds()
+	for y := start; y < end; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			w := weight(x, y)
+			if w >= 1 {
+				continue
+			}
+			in, out := pixel(img.In, x, y), pixel(img.Out, x, y)
+			for ch := range out {
+				out[ch] = in[ch] + w*(out[ch]-in[ch])
+			}
+			setPixel(img.Out, x, y, out)
+		}
+	}
+}
+
+// mask returns the weight of the effect's result at each pixel, from 0 (keep the
+// input) to 1 (take the result), or nil if the effect has no mask. The effect
+// must have passed Validate and had its image files loaded.
+func (spec EffectSpec) mask() func(x, y int) float64 {
+	weight, err := spec.maskWeight()
+	if err != nil {
+		panic(err)
+	}
+	return weight
+}
+
+// maskWeight is mask, reporting a malformed mask parameter as an error.
+func (spec EffectSpec) maskWeight() (func(x, y int) float64, error) {
+	switch m := spec.Params["mask"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		img, ok := spec.Images["mask"]
+		if !ok {
+			return nil, fmt.Errorf("mask image %q is not loaded", m)
+		}
+		return func(x, y int) float64 {
+			c := pixel(img, x, y)
+			return luminance(c[0], c[1], c[2]) / 65535
+		}, nil
+	case map[string]interface{}:
+		if points, ok := m["points"]; ok {
+			if len(m) > 1 {
+				return nil, fmt.Errorf("a polygon mask takes only points")
+			}
+			return polygonMask(points)
+		}
+		var rect [4]float64
+		for i, key := range []string{"x", "y", "width", "height"} {
+			v, ok := m[key].(float64)
+			if !ok {
+				return nil, fmt.Errorf("a rectangle mask needs a numeric %s", key)
+			}
+			rect[i] = v
+		}
+		if len(m) > 4 {
+			return nil, fmt.Errorf("a rectangle mask takes only x, y, width and height")
+		}
+		if rect[2] <= 0 || rect[3] <= 0 {
+			return nil, fmt.Errorf("a rectangle mask needs a positive width and height")
+		}
+		return func(x, y int) float64 {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			if px >= rect[0] && px < rect[0]+rect[2] && py >= rect[1] && py < rect[1]+rect[3] {
+				return 1
+			}
+			return 0
+		}, nil
+	}
+	return nil, fmt.Errorf("mask must be an image file name, a rectangle or a polygon")
+}
+
+// polygonMask parses a list of [x, y] points into a mask that covers the pixels
+// whose centers lie inside the polygon, by the even-odd rule.
+func polygonMask(value interface{}) (func(x, y int) float64, error) {
+	list, _ := value.([]interface{})
+	if len(list) < 3 {
+		return nil, fmt.Errorf("a polygon mask needs at least 3 points")
+	}
+	xs, ys := make([]float64, len(list)), make([]float64, len(list))
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for i, p := range list {
+		pair, _ := p.([]interface{})
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("polygon point %d must be an [x, y] pair", i+1)
+		}
+		x, xok := pair[0].(float64)
+		y, yok := pair[1].(float64)
+		if !xok || !yok {
+			return nil, fmt.Errorf("polygon point %d must be an [x, y] pair", i+1)
+		}
+		xs[i], ys[i] = x, y
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	return func(x, y int) float64 {
+		px, py := float64(x)+0.5, float64(y)+0.5
+		if py < minY || py > maxY {
+			return 0
+		}
+		inside := false
+		for i, j := 0, len(xs)-1; i < len(xs); j, i = i, i+1 {
+			if (ys[i] > py) != (ys[j] > py) && px < xs[i]+(py-ys[i])*(xs[j]-xs[i])/(ys[j]-ys[i]) {
+				inside = !inside
+			}
+		}
+		if inside {
+			return 1
+		}
+		return 0
+	}, nil
+}
+
+// ImageFiles returns the parameters of the effect that name image files, sorted.
+// The job loader decodes them into Images before the effect runs.
+func (spec EffectSpec) ImageFiles() []string {
+	var keys []string
+	for key, kind := range effectParams[spec.Name] {
+		if _, ok := spec.Params[key].(string); ok && (kind == "image" || kind == "mask") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
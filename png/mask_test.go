@@ -0,0 +1,114 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// TestMasks inverts a translucent image through each kind of mask, and inverts
+// only its alpha through a rectangle. Each result pixel must be the input mixed
+// with its inverse by the mask's weight there.
+func TestMasks(t *testing.T) {
+	const size = 9
+	// colorAt returns the unpremultiplied input at (x, y)
+	colorAt := func(x, y int) [4]float64 {
+		return [4]float64{float64(x) / 10, float64(y) / 10, 0.5, 0.25 + 0.5*float64(x+y)/16}
+	}
+	// The mask image is black, mid gray and white in thirds from the left
+	maskImage := image.NewRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := uint16(x / 3 * 32767)
+			maskImage.SetRGBA64(x, y, color.RGBA64{v, v, v, 65535})
+		}
+	}
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		weight func(x, y int) float64
+		alpha  bool // the effect runs on alpha alone
+	}{
+		{
+			"rectangle",
+			map[string]interface{}{"mask": map[string]interface{}{"x": 2.0, "y": 3.0, "width": 4.0, "height": 5.0}},
+			func(x, y int) float64 { return b2f(x >= 2 && x < 6 && y >= 3 && y < 8) },
+			false,
+		},
+		{
+			// The pixels whose centers are above the diagonal x + y = 8
+			"polygon",
+			map[string]interface{}{"mask": map[string]interface{}{"points": []interface{}{[]interface{}{0.0, 0.0}, []interface{}{8.0, 0.0}, []interface{}{0.0, 8.0}}}},
+			func(x, y int) float64 { return b2f(x+y+1 < 8) },
+			false,
+		},
+		{
+			"image",
+			map[string]interface{}{"mask": "mask.png"},
+			func(x, y int) float64 { return float64(x/3*32767) / 65535 },
+			false,
+		},
+		{
+			"alpha in a rectangle",
+			map[string]interface{}{"channels": "A", "mask": map[string]interface{}{"x": 0.0, "y": 0.0, "width": 5.0, "height": 9.0}},
+			func(x, y int) float64 { return b2f(x < 5) },
+			true,
+		},
+	}
+	for _, float := range []bool{false, true} {
+		for _, test := range tests {
+			var src Buffer = image.NewRGBA64(image.Rect(0, 0, size, size))
+			if float {
+				src = NewFloat(image.Rect(0, 0, size, size))
+			}
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					c := colorAt(x, y)
+					setPixel(src, x, y, [4]float64{c[0] * c[3] * 65535, c[1] * c[3] * 65535, c[2] * c[3] * 65535, c[3] * 65535})
+				}
+			}
+			spec := EffectSpec{Name: "invert", Params: test.params}
+			if err := spec.Validate(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if _, ok := test.params["mask"].(string); ok {
+				spec.Images = map[string]Buffer{"mask": maskImage}
+			}
+			// Premultiplied, so invert works on the colors rather than the stored values
+			img := &Image{In: src, Out: NewBuffer(src, src.Bounds()), Bounds: src.Bounds(), Premultiplied: true}
+			img.ApplyEffects([]EffectSpec{spec}, false, 0, 0)
+			// 16-bit buffers truncate at every stage
+			tolerance := 4.0
+			if float {
+				tolerance = 0.05
+			}
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					c := colorAt(x, y)
+					in := [4]float64{c[0] * c[3], c[1] * c[3], c[2] * c[3], c[3]}
+					inverted := [4]float64{(1 - c[0]) * c[3], (1 - c[1]) * c[3], (1 - c[2]) * c[3], c[3]}
+					if test.alpha {
+						a := 1 - c[3]
+						inverted = [4]float64{c[0] * a, c[1] * a, c[2] * a, a}
+					}
+					w := test.weight(x, y)
+					got := pixel(img.Out, x, y)
+					for ch := range got {
+						want := (in[ch] + w*(inverted[ch]-in[ch])) * 65535
+						if math.Abs(got[ch]-want) > tolerance {
+							t.Errorf("%s, float %v: (%d, %d) channel %d is %.1f, want %.1f", test.name, float, x, y, ch, got[ch], want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
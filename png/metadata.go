@@ -0,0 +1,204 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+)
+
+// Chunk is an ancillary PNG chunk carried from the source image to the output:
+// text (tEXt, iTXt, zTXt), color (gAMA, cHRM, sRGB, iCCP) or resolution (pHYs).
+type Chunk struct {
+	Type string
+	Data []byte
+}
+
+// keptChunks are the ancillary chunk types read from a source and written back.
+var keptChunks = map[string]bool{
+	"tEXt": true, "iTXt": true, "zTXt": true,
+	"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true,
+	"pHYs": true,
+}
+
+// colorChunks describe the color space of the pixels.
+var colorChunks = map[string]bool{"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// readChunks returns the kept ancillary chunks of an encoded PNG, in order. Other
+// formats have none.
+func readChunks(data []byte) []Chunk {
+	var chunks []Chunk
+	walkChunks(data, func(typ string, body []byte) {
+		if keptChunks[typ] {
+			chunks = append(chunks, Chunk{Type: typ, Data: append([]byte(nil), body...)})
+		}
+	})
+	return chunks
+}
+
+// walkChunks calls fn with every chunk of an encoded PNG before IEND. It does
+// nothing for other formats and stops early at a truncated chunk.
+func walkChunks(data []byte, fn func(typ string, body []byte)) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return
+	}
+	for rest := data[len(pngSignature):]; len(rest) >= 12; {
+		length := binary.BigEndian.Uint32(rest)
+		if uint64(length)+12 > uint64(len(rest)) {
+			return
+		}
+		typ := string(rest[4:8])
+		if typ == "IEND" {
+			return
+		}
+		fn(typ, rest[8:8+length])
+		rest = rest[12+length:]
+	}
+}
+
+// Text returns the text stored under keyword in a tEXt or iTXt chunk, if any.
+func (img *Image) Text(keyword string) (string, bool) {
+	for _, chunk := range img.Chunks {
+		if chunkKeyword(chunk) != keyword {
+			continue
+		}
+		switch chunk.Type {
+		case "tEXt":
+			return string(chunk.Data[len(keyword)+1:]), true
+		case "iTXt":
+			// keyword, NUL, compression flag and method, language tag, NUL, translated keyword, NUL, text
+			if len(chunk.Data) < len(keyword)+3 {
+				return "", false
+			}
+			fields := bytes.SplitN(chunk.Data[len(keyword)+3:], []byte{0}, 3)
+			if len(fields) == 3 && chunk.Data[len(keyword)+1] == 0 {
+				return string(fields[2]), true
+			}
+		}
+	}
+	return "", false
+}
+
+// chunkKeyword returns the keyword of a text chunk, or "" for other chunks.
+func chunkKeyword(chunk Chunk) string {
+	switch chunk.Type {
+	case "tEXt", "iTXt", "zTXt":
+		if i := bytes.IndexByte(chunk.Data, 0); i >= 0 {
+			return string(chunk.Data[:i])
+		}
+	}
+	return ""
+}
+
+// textChunk stores text under keyword, as tEXt when it is Latin-1 and as
+// uncompressed iTXt otherwise.
+func textChunk(keyword string, text string) Chunk {
+	latin1 := true
+	for _, r := range text {
+		if r > 0xff {
+			latin1 = false
+			break
+		}
+	}
+	if latin1 {
+		data := []byte(keyword + "\x00")
+		for _, r := range text {
+			data = append(data, byte(r))
+		}
+		return Chunk{Type: "tEXt", Data: data}
+	}
+	return Chunk{Type: "iTXt", Data: []byte(keyword + "\x00\x00\x00\x00\x00" + text)}
+}
+
+// physChunk records a resolution in dots per inch.
+func physChunk(dpi float64) Chunk {
+	ppm := uint32(math.Round(dpi / 0.0254))
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint32(data, ppm)
+	binary.BigEndian.PutUint32(data[4:], ppm)
+	data[8] = 1 // unit is the meter
+	return Chunk{Type: "pHYs", Data: data}
+}
+
+// metadata returns the ancillary chunks to write for opts: the source's chunks,
+// minus the stripped types, with text and resolution overrides applied.
+func (img *Image) metadata(opts SaveOptions) []Chunk {
+	strip := make(map[string]bool)
+	for _, typ := range opts.StripMetadata {
+		if typ == "all" {
+			for t := range keptChunks {
+				strip[t] = true
+			}
+		}
+		strip[typ] = true
+	}
+	// An RGB profile doesn't describe gray output
+	if opts.Gray {
+		strip["iCCP"] = true
+	}
+	if opts.DPI > 0 {
+		strip["pHYs"] = true
+	}
+	var chunks []Chunk
+	for _, chunk := range img.Chunks {
+		if strip[chunk.Type] {
+			continue
+		}
+		if _, ok := opts.Text[chunkKeyword(chunk)]; ok {
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+	if opts.DPI > 0 {
+		chunks = append(chunks, physChunk(opts.DPI))
+	}
+	if len(img.Exif) > 0 && !opts.StripExif {
+		chunks = append(chunks, Chunk{Type: "eXIf", Data: img.Exif})
+	}
+	keywords := make([]string, 0, len(opts.Text))
+	for keyword := range opts.Text {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		chunks = append(chunks, textChunk(keyword, opts.Text[keyword]))
+	}
+	return chunks
+}
+
+// writeChunks copies an encoded PNG to w with extra chunks inserted right after
+// IHDR, which is before PLTE and IDAT as the color chunks require.
+func writeChunks(w io.Writer, encoded []byte, chunks []Chunk) error {
+	ihdrEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(encoded[len(pngSignature):]))
+	if _, err := w.Write(encoded[:ihdrEnd]); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := writeChunk(w, chunk.Type, chunk.Data); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(encoded[ihdrEnd:])
+	return err
+}
+
+// writeChunk writes one PNG chunk with its length and checksum.
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	footer := binary.BigEndian.AppendUint32(nil, crc.Sum32())
+	for _, part := range [][]byte{header, data, footer} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
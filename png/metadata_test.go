@@ -0,0 +1,16 @@
+package png
+
+import "testing"
+
+func TestTextTruncatedITXt(t *testing.T) {
+	for _, data := range []string{"Comment\x00", "Comment\x00\x00"} {
+		img := &Image{Chunks: []Chunk{{Type: "iTXt", Data: []byte(data)}}}
+		if text, ok := img.Text("Comment"); ok {
+			t.Errorf("truncated iTXt %q gave text %q", data, text)
+		}
+	}
+	img := &Image{Chunks: []Chunk{textChunk("Comment", "naïve ✓")}}
+	if text, ok := img.Text("Comment"); !ok || text != "naïve ✓" {
+		t.Errorf("iTXt round trip gave %q, %v", text, ok)
+	}
+}
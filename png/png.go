@@ -1,11 +1,14 @@
-// Package png allows for loading png images and applying
-// image flitering effects on them
+// Package png allows for loading images and applying
+// image flitering effects on them. Despite the name it reads
+// PNG, JPEG, GIF, BMP, TIFF and WebP, and writes all but WebP.
 package png
 
 import (
+	"bytes"
 	"image"
 	"image/color"
-	"image/png"
+	"image/draw"
+	"io"
 	"math"
 	"os"
 )
@@ -13,9 +16,20 @@ import (
 // The Image represents a structure for working with PNG images.
 // You are allowed to update this and change it as you wish!
 type Image struct {
-	In     *image.RGBA64   //The original pixels before applying the effect
-	Out    *image.RGBA64   //The updated pixels after applying teh effect
+	In     Buffer          //The original pixels before applying the effect
+	Out    Buffer          //The updated pixels after applying teh effect
 	Bounds image.Rectangle //The size of the image
+	// Premultiplied makes convolutions filter alpha along with the color channels.
+	// RGBA64 colors are alpha-premultiplied, so this is the correct convolution for
+	// images with transparency; the default copies the center pixel's alpha through,
+	// which leaves dark fringes where opaque pixels meet transparent ones. Point
+	// operations are applied to the unpremultiplied colors in this mode.
+	Premultiplied bool
+	Format        string      // The format the image was decoded from, e.g. "png" or "jpeg"
+	ColorModel    color.Model // The color model of the decoded image, before widening to RGBA64
+	Chunks        []Chunk     // Ancillary PNG chunks of the source, written back on save
+	Exif          []byte      // EXIF block of a JPEG or PNG source, from the TIFF header on
+	Linear        bool        // In and Out hold linear light rather than sRGB, see Linearize
 }
 
 func NewImage() *Image {
@@ -27,7 +41,7 @@ func NewImage() *Image {
 }
 
 func (img *Image) DuplicateImage() *Image {
-	return &Image{img.In, img.Out, image.Rect(0, 0, img.In.Bounds().Max.X, img.In.Bounds().Max.Y)}
+	return &Image{In: img.In, Out: img.Out, Bounds: image.Rect(0, 0, img.In.Bounds().Max.X, img.In.Bounds().Max.Y), Premultiplied: img.Premultiplied, Linear: img.Linear}
 }
 
 // Public functions
@@ -44,45 +58,95 @@ func Load(filePath string) (*Image, error) {
 	}
 	defer inReader.Close()
 
-	inOrig, err := png.Decode(inReader)
+	return Decode(inReader)
+}
 
+// Decode reads an image in any of the supported formats from r into In. Out is
+// left nil; ApplyEffects allocates it when it runs.
+func Decode(r io.Reader) (*Image, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	inOrig, format, err := image.Decode(bytes.NewReader(data))
 
-	bounds := inOrig.Bounds()
+	if err != nil {
+		return nil, err
+	}
 
-	outImg := image.NewRGBA64(bounds)
-	inImg := image.NewRGBA64(bounds)
+	bounds := inOrig.Bounds()
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := inOrig.At(x, y).RGBA()
-			inImg.Set(x, y, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
-		}
-	}
+	inImg := newRGBA64(bounds)
+	draw.Draw(inImg, bounds, inOrig, bounds.Min, draw.Src)
 	task := &Image{}
 	task.In = inImg
-	task.Out = outImg
 	task.Bounds = bounds
+	task.Format = format
+	task.ColorModel = inOrig.ColorModel()
+	task.Chunks = readChunks(data)
+	task.Exif = readExif(data)
 	return task, nil
 }
 
-// Save saves the image to the given file
+// Save saves the image to the given file, in the format its extension names
 // You are allowed to modify and update this as you wish
 func (img *Image) Save(filePath string) bool {
+	if err := img.SaveAs(filePath, SaveOptions{}); err != nil {
+		panic(err)
+	}
+	return true
+}
 
-	outWriter, err := os.Create(filePath)
+// SaveAs saves the image to the given file with explicit encoder options
+func (img *Image) SaveAs(filePath string, opts SaveOptions) error {
+	format, err := FormatFor(filePath, opts.Format)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer outWriter.Close()
+	opts.Format = format
 
-	err = png.Encode(outWriter, img.Out)
+	outWriter, err := CreateAtomic(filePath)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return true
+	if err := img.Encode(outWriter, opts); err != nil {
+		outWriter.Abort()
+		return err
+	}
+	return outWriter.Close()
+}
+
+// Encode writes Out to w. Without an explicit format in opts it writes PNG.
+func (img *Image) Encode(w io.Writer, opts SaveOptions) error {
+	if opts.Format == "" {
+		opts.Format = "png"
+	}
+	format, err := FormatFor("", opts.Format)
+	if err != nil {
+		return err
+	}
+	m, err := img.output(opts)
+	if err != nil {
+		return err
+	}
+	defer img.release(m)
+	if format == "png" {
+		if chunks := img.metadata(opts); len(chunks) > 0 {
+			var buf bytes.Buffer
+			if err := encode(&buf, m, format, opts); err != nil {
+				return err
+			}
+			return writeChunks(w, buf.Bytes(), chunks)
+		}
+	}
+	if format == "jpeg" && len(img.Exif) > 0 && !opts.StripExif {
+		var buf bytes.Buffer
+		if err := encode(&buf, m, format, opts); err != nil {
+			return err
+		}
+		return writeExif(w, buf.Bytes(), img.Exif)
+	}
+	return encode(w, m, format, opts)
 }
 
 // clamp will clamp the comp parameter to zero if it is less than zero or to 65535 if the comp parameter
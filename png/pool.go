@@ -0,0 +1,140 @@
+package png
+
+import (
+	"image"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// poolBuckets is the number of size buckets of the pools of each kind of buffer,
+// four sizes to every doubling of the pixel count, up to 2^40 pixels. A run over
+// many images of similar sizes keeps reusing the same few allocations instead of
+// making fresh ones for every effect and letting the garbage collector chase them.
+// NewBuffer, NewFloat and Decode borrow from the pools and clear what they get, so
+// a borrowed buffer is as empty as a new one. Giving a buffer back with PutBuffer
+// is optional, and only allowed once nothing refers to it any more; one that is
+// never given back is collected as before.
+const poolBuckets = 4 * 39
+
+var (
+	floatPools  [poolBuckets]sync.Pool // of *[]float32
+	rgba64Pools [poolBuckets]sync.Pool // of *[]uint8
+	poolStats   struct{ gets, misses, puts, bytes int64 }
+)
+
+// PoolStats counts what the buffer pools have done since the program started.
+type PoolStats struct {
+	Gets   int64 // buffers borrowed
+	Misses int64 // borrowed buffers the pools had none for and allocated
+	Puts   int64 // buffers given back
+	Bytes  int64 // bytes allocated on misses
+}
+
+// BufferStats returns the counters of the buffer pools.
+func BufferStats() PoolStats {
+	return PoolStats{
+		Gets:   atomic.LoadInt64(&poolStats.gets),
+		Misses: atomic.LoadInt64(&poolStats.misses),
+		Puts:   atomic.LoadInt64(&poolStats.puts),
+		Bytes:  atomic.LoadInt64(&poolStats.bytes),
+	}
+}
+
+// bucketSize returns the number of pixels the buffers of bucket b hold: 4, 5, 6,
+// 7, 8, 10, 12 and so on.
+func bucketSize(b int) int {
+	return (4 + b%4) << (b / 4)
+}
+
+// getBucket returns the smallest bucket whose buffers hold at least n pixels.
+func getBucket(n int) int {
+	if n <= 4 {
+		return 0
+	}
+	e := bits.Len(uint(n-1)) - 3
+	return 4*e + int((n-1)>>e) + 1 - 4
+}
+
+// putBucket returns the bucket a buffer with room for n pixels goes back to, the
+// largest whose requests it can serve, or -1 if it is too small for any.
+func putBucket(n int) int {
+	if n < 4 {
+		return -1
+	}
+	e := bits.Len(uint(n)) - 3
+	return 4*e + n>>e - 4
+}
+
+// newFloatPix borrows a cleared slice of n float32 pixels.
+func newFloatPix(n int) []float32 {
+	atomic.AddInt64(&poolStats.gets, 1)
+	b := getBucket(n)
+	if n == 0 || b >= poolBuckets {
+		atomic.AddInt64(&poolStats.misses, 1)
+		atomic.AddInt64(&poolStats.bytes, int64(16*n))
+		return make([]float32, 4*n)
+	}
+	if p, ok := floatPools[b].Get().(*[]float32); ok {
+		pix := (*p)[:4*n]
+		for i := range pix {
+			pix[i] = 0
+		}
+		return pix
+	}
+	atomic.AddInt64(&poolStats.misses, 1)
+	atomic.AddInt64(&poolStats.bytes, int64(16*bucketSize(b)))
+	return make([]float32, 4*n, 4*bucketSize(b))
+}
+
+// newRGBA64Pix borrows a cleared slice of n 16-bit pixels.
+func newRGBA64Pix(n int) []uint8 {
+	atomic.AddInt64(&poolStats.gets, 1)
+	b := getBucket(n)
+	if n == 0 || b >= poolBuckets {
+		atomic.AddInt64(&poolStats.misses, 1)
+		atomic.AddInt64(&poolStats.bytes, int64(8*n))
+		return make([]uint8, 8*n)
+	}
+	if p, ok := rgba64Pools[b].Get().(*[]uint8); ok {
+		pix := (*p)[:8*n]
+		for i := range pix {
+			pix[i] = 0
+		}
+		return pix
+	}
+	atomic.AddInt64(&poolStats.misses, 1)
+	atomic.AddInt64(&poolStats.bytes, int64(8*bucketSize(b)))
+	return make([]uint8, 8*n, 8*bucketSize(b))
+}
+
+// newRGBA64 is image.NewRGBA64 with the pixels from the pools.
+func newRGBA64(r image.Rectangle) *image.RGBA64 {
+	return &image.RGBA64{Pix: newRGBA64Pix(r.Dx() * r.Dy()), Stride: 8 * r.Dx(), Rect: r}
+}
+
+// PutBuffer gives m back to the pools for NewBuffer to hand out again. Nothing may
+// use m afterwards, nor any image sharing its pixels. Buffers of other kinds are
+// left alone.
+func PutBuffer(m Buffer) {
+	switch m := m.(type) {
+	case *Float:
+		if m.Stride != 4*m.Rect.Dx() || len(m.Pix) != 4*m.Rect.Dx()*m.Rect.Dy() {
+			return
+		}
+		if b := putBucket(cap(m.Pix) / 4); b >= 0 && b < poolBuckets {
+			pix := m.Pix[:0]
+			floatPools[b].Put(&pix)
+			atomic.AddInt64(&poolStats.puts, 1)
+		}
+	case *image.RGBA64:
+		if m.Stride != 8*m.Rect.Dx() || len(m.Pix) != 8*m.Rect.Dx()*m.Rect.Dy() {
+			return
+		}
+		if b := putBucket(cap(m.Pix) / 8); b >= 0 && b < poolBuckets {
+			pix := m.Pix[:0]
+			rgba64Pools[b].Put(&pix)
+			atomic.AddInt64(&poolStats.puts, 1)
+		}
+	}
+}
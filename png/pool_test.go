@@ -0,0 +1,45 @@
+package png
+
+import "testing"
+
+// BenchmarkApplyEffects runs a chain of three passes over a 1024x768 image of each
+// kind of buffer and reports allocations and pool misses per run, which the pools
+// keep near zero once they are warm.
+func BenchmarkApplyEffects(b *testing.B) {
+	for _, float := range []bool{false, true} {
+		name := "rgba64"
+		if float {
+			name = "float32"
+		}
+		src := noise(1024, 768, float)
+		effects := Specs("S", "E", "B")
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			misses := BufferStats().Misses
+			for i := 0; i < b.N; i++ {
+				img := &Image{In: src, Out: NewBuffer(src, src.Bounds()), Bounds: src.Bounds()}
+				img.ApplyEffects(effects, false, 0, 0)
+				PutBuffer(img.Out)
+			}
+			b.ReportMetric(float64(BufferStats().Misses-misses)/float64(b.N), "misses/op")
+		})
+	}
+}
+
+// TestApplyEffectsKeepsIn checks that ApplyEffects leaves In as it was and gives
+// back every buffer it borrowed but Out.
+func TestApplyEffectsKeepsIn(t *testing.T) {
+	for _, float := range []bool{false, true} {
+		src := noise(64, 48, float)
+		before := BufferStats()
+		img := &Image{In: src, Out: NewBuffer(src, src.Bounds()), Bounds: src.Bounds()}
+		img.ApplyEffects(Specs("S", "E", "B"), false, 0, 0)
+		if img.In != src {
+			t.Errorf("float %v: In is not the input after the effects", float)
+		}
+		PutBuffer(img.Out)
+		if after := BufferStats(); after.Gets-before.Gets != after.Puts-before.Puts {
+			t.Errorf("float %v: borrowed %d buffers and gave back %d", float, after.Gets-before.Gets, after.Puts-before.Puts)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package png
+
+import (
+	"image"
+	"math"
+)
+
+// Convolution works on tiles of the image loaded channel by channel into float32
+// planes, so every kernel tap is one multiply-add over contiguous rows: a loop the
+// compiler keeps free of bounds checks and that, built with the avx2 tag on amd64,
+// runs eight pixels at a time.
+
+const (
+	tileWidth  = 256 // columns a tile writes
+	tileHeight = 32  // rows a tile writes
+)
+
+// planes holds a rectangle of pixels as one slice per channel, row after row. The
+// values are in the units of the buffer they were loaded from: 0..1 for a Float,
+// 0..65535 for anything else.
+type planes struct {
+	rect  image.Rectangle
+	float bool
+	ch    [4][]float32
+}
+
+// reset sizes the planes for r, reusing their memory.
+func (p *planes) reset(r image.Rectangle, float bool) {
+	size := r.Dx() * r.Dy()
+	for c := range p.ch {
+		if cap(p.ch[c]) < size {
+			p.ch[c] = make([]float32, size)
+		}
+		p.ch[c] = p.ch[c][:size]
+	}
+	p.rect, p.float = r, float
+}
+
+// row returns the part of channel c that holds row y.
+func (p *planes) row(c int, y int) []float32 {
+	w := p.rect.Dx()
+	i := (y - p.rect.Min.Y) * w
+	return p.ch[c][i : i+w]
+}
+
+// load fills the planes with the pixels of m in r, which read as transparent
+// black outside its bounds.
+func (p *planes) load(m Buffer, r image.Rectangle) {
+	_, float := m.(*Float)
+	p.reset(r, float)
+	in := r.Intersect(m.Bounds())
+	if in != r {
+		for c := range p.ch {
+			for i := range p.ch[c] {
+				p.ch[c][i] = 0
+			}
+		}
+	}
+	for y := in.Min.Y; y < in.Max.Y; y++ {
+		x0 := in.Min.X - r.Min.X
+		r0, g0, b0, a0 := p.row(0, y)[x0:], p.row(1, y)[x0:], p.row(2, y)[x0:], p.row(3, y)[x0:]
+		switch m := m.(type) {
+		case *Float:
+			pix := m.Pix[m.PixOffset(in.Min.X, y):m.PixOffset(in.Max.X, y)]
+			for j := 0; j < len(pix)/4; j++ {
+				r0[j], g0[j], b0[j], a0[j] = pix[4*j], pix[4*j+1], pix[4*j+2], pix[4*j+3]
+			}
+		case *image.RGBA64:
+			pix := m.Pix[m.PixOffset(in.Min.X, y):m.PixOffset(in.Max.X, y)]
+			for j := 0; j < len(pix)/8; j++ {
+				s := pix[8*j : 8*j+8]
+				r0[j] = float32(uint16(s[0])<<8 | uint16(s[1]))
+				g0[j] = float32(uint16(s[2])<<8 | uint16(s[3]))
+				b0[j] = float32(uint16(s[4])<<8 | uint16(s[5]))
+				a0[j] = float32(uint16(s[6])<<8 | uint16(s[7]))
+			}
+		default:
+			for x := in.Min.X; x < in.Max.X; x++ {
+				c := pixel(m, x, y)
+				j := x - in.Min.X
+				r0[j], g0[j], b0[j], a0[j] = float32(c[0]), float32(c[1]), float32(c[2]), float32(c[3])
+			}
+		}
+	}
+}
+
+// store writes the planes to dst as setPixel would, first limiting each color to
+// its alpha in a 16-bit buffer if premultiplied is set, as premultipliedColor does.
+func (p *planes) store(dst Buffer, premultiplied bool) {
+	r := p.rect.Intersect(dst.Bounds())
+	d, float := dst.(*Float)
+	if float && p.float {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			x0 := r.Min.X - p.rect.Min.X
+			r0, g0, b0, a0 := p.row(0, y)[x0:], p.row(1, y)[x0:], p.row(2, y)[x0:], p.row(3, y)[x0:]
+			pix := d.Pix[d.PixOffset(r.Min.X, y):d.PixOffset(r.Max.X, y)]
+			for j := 0; j < len(pix)/4; j++ {
+				pix[4*j], pix[4*j+1], pix[4*j+2], pix[4*j+3] = r0[j], g0[j], b0[j], a0[j]
+			}
+		}
+		return
+	}
+	scale := 1.0
+	if p.float {
+		scale = 65535
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := (y-p.rect.Min.Y)*p.rect.Dx() + x - p.rect.Min.X
+			c := [4]float64{float64(p.ch[0][i]) * scale, float64(p.ch[1][i]) * scale, float64(p.ch[2][i]) * scale, float64(p.ch[3][i]) * scale}
+			if premultiplied {
+				c = premultipliedColor(dst, c)
+			}
+			if m, ok := dst.(*image.RGBA64); ok {
+				s := m.Pix[m.PixOffset(x, y) : m.PixOffset(x, y)+8]
+				for ch, v := range c {
+					v16 := Clamp(v)
+					s[2*ch], s[2*ch+1] = uint8(v16>>8), uint8(v16)
+				}
+				continue
+			}
+			setPixel(dst, x, y, c)
+		}
+	}
+}
+
+// convolveTiled is convolve summing every kernel tap, a tile at a time. The sums
+// are float32, so they can differ from float64 ones by float32 rounding, which a
+// Float applies on storage anyway.
+func convolveTiled(src Buffer, dst Buffer, kernel [][]float64, start int, end int, premultiplied bool) {
+	bounds := src.Bounds()
+	offset := len(kernel) / 2
+	weights := make([][]float32, len(kernel))
+	for ky, row := range kernel {
+		weights[ky] = make([]float32, len(row))
+		for kx, k := range row {
+			weights[ky][kx] = float32(k)
+		}
+	}
+	var in, out planes
+	for ty := start; ty < end; ty += tileHeight {
+		for tx := bounds.Min.X; tx < bounds.Max.X; tx += tileWidth {
+			r := image.Rect(tx, ty, int(math.Min(float64(tx+tileWidth), float64(bounds.Max.X))), int(math.Min(float64(ty+tileHeight), float64(end))))
+			in.load(src, r.Inset(-offset))
+			out.reset(r, in.float)
+			channels := 4
+			if !premultiplied {
+				// Alpha is the center pixel's
+				channels = 3
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					copy(out.row(3, y), in.row(3, y)[offset:])
+				}
+			}
+			for c := 0; c < channels; c++ {
+				convolvePlane(out.ch[c], r.Dx(), in.ch[c], in.rect.Dx(), weights)
+			}
+			out.store(dst, premultiplied)
+		}
+	}
+}
+
+// convolvePlane writes the sums of kernel over src, a plane stride values wide,
+// into dst, a plane w values wide and as many rows shorter than src as the kernel
+// is tall.
+func convolvePlane(dst []float32, w int, src []float32, stride int, kernel [][]float32) {
+	for i := range dst {
+		dst[i] = 0
+	}
+	rows := len(dst) / w
+	for ky, row := range kernel {
+		for kx, k := range row {
+			if k == 0 {
+				continue
+			}
+			for y := 0; y < rows; y++ {
+				i := (y+ky)*stride + kx
+				axpy(dst[y*w:(y+1)*w], src[i:i+w], k)
+			}
+		}
+	}
+}
+
+// axpyGo adds k times src to dst.
+func axpyGo(dst []float32, src []float32, k float32) {
+	src = src[:len(dst)]
+	for i := range dst {
+		dst[i] += k * src[i]
+	}
+}
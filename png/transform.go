@@ -0,0 +1,285 @@
+package png
+
+import (
+	"image"
+	"math"
+)
+
+// Geometric reports whether the effect produces an image whose bounds differ from
+// its input. Such effects need the whole image and can't be run on a chunk.
+func (spec EffectSpec) Geometric() bool {
+	switch spec.Name {
+	case "crop", "flipH", "flipV", "rotate", "resize":
+		return true
+	}
+	return false
+}
+
+// Transform runs a geometric effect on In and replaces Out (and Bounds) with the
+// result, which is always anchored at the origin.
+func (img *Image) Transform(effect EffectSpec) {
+	var out Buffer
+	switch effect.Name {
+	case "crop":
+		out = Crop(img.In, image.Rect(0, 0, int(effect.Float("width", 0)), int(effect.Float("height", 0))).
+			Add(image.Pt(int(effect.Float("x", 0)), int(effect.Float("y", 0)))))
+	case "flipH":
+		out = FlipH(img.In)
+	case "flipV":
+		out = FlipV(img.In)
+	case "rotate":
+		out = Rotate(img.In, effect.Float("angle", 0))
+	case "resize":
+		bounds := img.In.Bounds()
+		w, h := int(effect.Float("width", 0)), int(effect.Float("height", 0))
+		// A missing dimension keeps the aspect ratio
+		if w <= 0 && h > 0 {
+			w = int(math.Round(float64(bounds.Dx()) * float64(h) / float64(bounds.Dy())))
+		} else if h <= 0 && w > 0 {
+			h = int(math.Round(float64(bounds.Dy()) * float64(w) / float64(bounds.Dx())))
+		} else if w <= 0 && h <= 0 {
+			w, h = bounds.Dx(), bounds.Dy()
+		}
+		out = Resize(img.In, w, h, effect.String("filter", "bilinear"))
+	default:
+		return
+	}
+	img.Out = out
+	img.Bounds = out.Bounds()
+}
+
+// Crop copies the part of src inside rect into a new image anchored at the origin.
+func Crop(src Buffer, rect image.Rectangle) Buffer {
+	rect = rect.Intersect(src.Bounds())
+	dst := NewBuffer(src, image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	CopyRect(dst, dst.Bounds(), src, rect.Min)
+	return dst
+}
+
+// FlipH mirrors src left to right.
+func FlipH(src Buffer) Buffer {
+	b := src.Bounds()
+	dst := NewBuffer(src, image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			setPixel(dst, x, y, pixel(src, b.Max.X-1-x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// FlipV mirrors src top to bottom.
+func FlipV(src Buffer) Buffer {
+	b := src.Bounds()
+	dst := NewBuffer(src, image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		CopyRect(dst, image.Rect(0, y, b.Dx(), y+1), src, image.Pt(b.Min.X, b.Max.Y-1-y))
+	}
+	return dst
+}
+
+// Rotate turns src counter-clockwise by angle degrees. Multiples of 90 are exact
+// pixel moves; any other angle is bilinearly resampled onto a canvas large enough
+// to hold the whole result, with transparent corners.
+func Rotate(src Buffer, angle float64) Buffer {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	switch angle {
+	case 0:
+		return Crop(src, b)
+	case 90:
+		dst := NewBuffer(src, image.Rect(0, 0, h, w))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				setPixel(dst, y, w-1-x, pixel(src, b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return dst
+	case 180:
+		return FlipV(FlipH(src))
+	case 270:
+		dst := NewBuffer(src, image.Rect(0, 0, h, w))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				setPixel(dst, h-1-y, x, pixel(src, b.Min.X+x, b.Min.Y+y))
+			}
+		}
+		return dst
+	}
+
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	dw := int(math.Ceil(math.Abs(float64(w)*cos) + math.Abs(float64(h)*sin)))
+	dh := int(math.Ceil(math.Abs(float64(w)*sin) + math.Abs(float64(h)*cos)))
+	dst := NewBuffer(src, image.Rect(0, 0, dw, dh))
+	cx, cy := float64(w)/2, float64(h)/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Map the destination pixel center back into the source
+			dx, dy := float64(x)+0.5-dcx, float64(y)+0.5-dcy
+			sx := cos*dx - sin*dy + cx - 0.5
+			sy := sin*dx + cos*dy + cy - 0.5
+			setPixel(dst, x, y, bilinearAt(src, sx, sy))
+		}
+	}
+	return dst
+}
+
+// bilinearAt samples src at the fractional position (x, y) relative to its origin.
+// Pixels outside src count as transparent.
+func bilinearAt(src Buffer, x float64, y float64) [4]float64 {
+	b := src.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+	var sum [4]float64
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 2; i++ {
+			px, py := x0+i, y0+j
+			if px < 0 || py < 0 || px >= b.Dx() || py >= b.Dy() {
+				continue
+			}
+			wt := (1 - math.Abs(float64(i)-fx)) * (1 - math.Abs(float64(j)-fy))
+			c := pixel(src, b.Min.X+px, b.Min.Y+py)
+			for ch := range sum {
+				sum[ch] += wt * c[ch]
+			}
+		}
+	}
+	return sum
+}
+
+// resampleFilter is a separable reconstruction filter with the given support radius.
+type resampleFilter struct {
+	support float64
+	kernel  func(float64) float64
+}
+
+var resampleFilters = map[string]resampleFilter{
+	"bilinear": {1, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}},
+	// Catmull-Rom
+	"bicubic": {2, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return (1.5*x-2.5)*x*x + 1
+		}
+		if x < 2 {
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}},
+	"lanczos": {3, func(x float64) float64 {
+		x = math.Abs(x)
+		if x == 0 {
+			return 1
+		}
+		if x < 3 {
+			px := math.Pi * x
+			return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+		}
+		return 0
+	}},
+}
+
+// Resize scales src to w x h using filter, one of "nearest", "bilinear", "bicubic"
+// or "lanczos". Unknown filters fall back to bilinear.
+func Resize(src Buffer, w int, h int, filter string) Buffer {
+	b := src.Bounds()
+	dst := NewBuffer(src, image.Rect(0, 0, w, h))
+	if w <= 0 || h <= 0 || b.Empty() {
+		return dst
+	}
+	if filter == "nearest" {
+		for y := 0; y < h; y++ {
+			sy := b.Min.Y + (2*y+1)*b.Dy()/(2*h)
+			for x := 0; x < w; x++ {
+				sx := b.Min.X + (2*x+1)*b.Dx()/(2*w)
+				setPixel(dst, x, y, pixel(src, sx, sy))
+			}
+		}
+		return dst
+	}
+	f, ok := resampleFilters[filter]
+	if !ok {
+		f = resampleFilters["bilinear"]
+	}
+
+	// Horizontal pass into a float buffer, then vertical pass into dst
+	tmp := make([]float64, 4*w*b.Dy())
+	xw := resampleWeights(b.Dx(), w, f)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for _, c := range xw[x] {
+				px := pixel(src, b.Min.X+c.index, b.Min.Y+y)
+				for ch := range sum {
+					sum[ch] += c.weight * px[ch]
+				}
+			}
+			copy(tmp[4*(y*w+x):], sum[:])
+		}
+	}
+	yw := resampleWeights(b.Dy(), h, f)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for _, c := range yw[y] {
+				i := 4 * (c.index*w + x)
+				for ch := 0; ch < 4; ch++ {
+					sum[ch] += c.weight * tmp[i+ch]
+				}
+			}
+			setPixel(dst, x, y, sum)
+		}
+	}
+	return dst
+}
+
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// resampleWeights returns, for every destination index, the normalized source
+// taps. When shrinking, the filter is stretched so it averages every source pixel.
+func resampleWeights(srcSize int, dstSize int, f resampleFilter) [][]contribution {
+	scale := float64(srcSize) / float64(dstSize)
+	stretch := math.Max(1, scale)
+	support := f.support * stretch
+	weights := make([][]contribution, dstSize)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		lo := int(math.Ceil(center - support))
+		hi := int(math.Floor(center + support))
+		var sum float64
+		for s := lo; s <= hi; s++ {
+			wt := f.kernel((float64(s) - center) / stretch)
+			if wt == 0 {
+				continue
+			}
+			// Clamp to the edge so borders don't darken
+			idx := s
+			if idx < 0 {
+				idx = 0
+			} else if idx >= srcSize {
+				idx = srcSize - 1
+			}
+			weights[i] = append(weights[i], contribution{idx, wt})
+			sum += wt
+		}
+		for k := range weights[i] {
+			weights[i][k].weight /= sum
+		}
+	}
+	return weights
+}
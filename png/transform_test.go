@@ -0,0 +1,176 @@
+package png
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// numbered returns a w×h opaque image whose pixels tell where they came from: red
+// is 1000 times x and green 1000 times y.
+func numbered(w int, h int, float bool) Buffer {
+	m := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetRGBA64(x, y, color.RGBA64{uint16(1000 * x), uint16(1000 * y), 7, 65535})
+		}
+	}
+	if !float {
+		return m
+	}
+	f := NewFloat(m.Rect)
+	CopyRect(f, m.Rect, m, m.Rect.Min)
+	return f
+}
+
+// transform runs a single geometric effect over src and returns the result.
+func transform(src Buffer, spec EffectSpec) Buffer {
+	img := &Image{In: src, Bounds: src.Bounds()}
+	img.Transform(spec)
+	return img.Out
+}
+
+func TestFlipRotate(t *testing.T) {
+	rotate := func(angle float64) EffectSpec {
+		return EffectSpec{Name: "rotate", Params: map[string]interface{}{"angle": angle}}
+	}
+	const w, h = 5, 3
+	tests := []struct {
+		spec EffectSpec
+		size image.Point
+		// from returns the source pixel that lands on (x, y)
+		from func(x, y int) (int, int)
+	}{
+		{EffectSpec{Name: "flipH"}, image.Pt(w, h), func(x, y int) (int, int) { return w - 1 - x, y }},
+		{EffectSpec{Name: "flipV"}, image.Pt(w, h), func(x, y int) (int, int) { return x, h - 1 - y }},
+		{rotate(0), image.Pt(w, h), func(x, y int) (int, int) { return x, y }},
+		// Counter-clockwise, so the top right corner goes to the top left
+		{rotate(90), image.Pt(h, w), func(x, y int) (int, int) { return w - 1 - y, x }},
+		{rotate(180), image.Pt(w, h), func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }},
+		{rotate(270), image.Pt(h, w), func(x, y int) (int, int) { return y, h - 1 - x }},
+		{rotate(-90), image.Pt(h, w), func(x, y int) (int, int) { return y, h - 1 - x }},
+		{rotate(450), image.Pt(h, w), func(x, y int) (int, int) { return w - 1 - y, x }},
+	}
+	for _, float := range []bool{false, true} {
+		src := numbered(w, h, float)
+		for _, test := range tests {
+			out := transform(src, test.spec)
+			if got, want := out.Bounds(), image.Rect(0, 0, test.size.X, test.size.Y); got != want {
+				t.Errorf("float %v, %v: bounds %v, want %v", float, test.spec, got, want)
+				continue
+			}
+			for y := 0; y < test.size.Y; y++ {
+				for x := 0; x < test.size.X; x++ {
+					sx, sy := test.from(x, y)
+					if got, want := pixel(out, x, y), pixel(src, sx, sy); got != want {
+						t.Errorf("float %v, %v: (%d, %d) is %v, want %v from (%d, %d)", float, test.spec, x, y, got, want, sx, sy)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRotateAnyAngle(t *testing.T) {
+	src := numbered(10, 10, false)
+	for _, test := range []struct {
+		angle float64
+		size  image.Point
+	}{
+		{45, image.Pt(15, 15)}, // 10√2 rounded up
+		{30, image.Pt(14, 14)}, // 10 cos 30 + 10 sin 30 rounded up
+		{-30, image.Pt(14, 14)},
+	} {
+		out := Rotate(src, test.angle)
+		if got, want := out.Bounds(), image.Rect(0, 0, test.size.X, test.size.Y); got != want {
+			t.Errorf("rotate %v: bounds %v, want %v", test.angle, got, want)
+			continue
+		}
+		if a := pixel(out, 0, 0)[3]; a != 0 {
+			t.Errorf("rotate %v: the corner has alpha %v, want transparent", test.angle, a)
+		}
+		if a := pixel(out, test.size.X/2, test.size.Y/2)[3]; a != 65535 {
+			t.Errorf("rotate %v: the center has alpha %v, want opaque", test.angle, a)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	// A flat image stays flat through every filter: the weights are normalized and
+	// the edges are clamped
+	flat := image.NewRGBA64(image.Rect(0, 0, 10, 6))
+	c := color.RGBA64{30000, 20000, 10000, 65535}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 10; x++ {
+			flat.SetRGBA64(x, y, c)
+		}
+	}
+	for _, filter := range []string{"nearest", "bilinear", "bicubic", "lanczos"} {
+		for _, test := range []struct {
+			width, height float64
+			size          image.Point
+		}{
+			{5, 3, image.Pt(5, 3)},
+			{25, 13, image.Pt(25, 13)},
+			{5, 0, image.Pt(5, 3)},    // the height keeps the aspect ratio
+			{0, 12, image.Pt(20, 12)}, // and so does the width
+			{0, 0, image.Pt(10, 6)},
+		} {
+			spec := EffectSpec{Name: "resize", Params: map[string]interface{}{"width": test.width, "height": test.height, "filter": filter}}
+			out := transform(flat, spec).(*image.RGBA64)
+			if got, want := out.Bounds(), image.Rect(0, 0, test.size.X, test.size.Y); got != want {
+				t.Errorf("%s %vx%v: bounds %v, want %v", filter, test.width, test.height, got, want)
+				continue
+			}
+			for y := 0; y < test.size.Y; y++ {
+				for x := 0; x < test.size.X; x++ {
+					got := out.RGBA64At(x, y)
+					for i, d := range []int{int(got.R) - int(c.R), int(got.G) - int(c.G), int(got.B) - int(c.B), int(got.A) - int(c.A)} {
+						if d < -1 || d > 1 {
+							t.Fatalf("%s %vx%v: (%d, %d) channel %d is %v, want %v", filter, test.width, test.height, x, y, i, got, c)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCrop(t *testing.T) {
+	src := numbered(8, 6, false)
+	for _, test := range []struct {
+		rect image.Rectangle
+		want image.Rectangle // the part of src the result holds
+	}{
+		{image.Rect(2, 1, 5, 4), image.Rect(2, 1, 5, 4)},
+		{image.Rect(-3, -2, 3, 2), image.Rect(0, 0, 3, 2)}, // hanging over the top left
+		{image.Rect(6, 4, 20, 20), image.Rect(6, 4, 8, 6)}, // and over the bottom right
+		{image.Rect(0, 0, 8, 6), image.Rect(0, 0, 8, 6)},   // the whole image
+		{image.Rect(10, 10, 14, 14), image.Rectangle{}},    // entirely outside
+		{image.Rect(3, 3, 3, 5), image.Rectangle{}},        // zero width
+	} {
+		out := Crop(src, test.rect)
+		if got, want := out.Bounds(), image.Rect(0, 0, test.want.Dx(), test.want.Dy()); got != want {
+			t.Errorf("crop %v: bounds %v, want %v", test.rect, got, want)
+			continue
+		}
+		for y := 0; y < test.want.Dy(); y++ {
+			for x := 0; x < test.want.Dx(); x++ {
+				if got, want := pixel(out, x, y), pixel(src, test.want.Min.X+x, test.want.Min.Y+y); got != want {
+					t.Errorf("crop %v: (%d, %d) is %v, want %v", test.rect, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	// The effect itself refuses an empty rectangle before it runs
+	for _, params := range []map[string]interface{}{
+		{"width": 0.0, "height": 4.0},
+		{"width": 4.0},
+		{"x": 2.0, "y": 2.0, "width": -1.0, "height": 4.0},
+	} {
+		if err := (EffectSpec{Name: "crop", Params: params}).Validate(); err == nil {
+			t.Errorf("crop %v validated", params)
+		}
+	}
+}
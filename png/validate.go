@@ -0,0 +1,200 @@
+package png
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// effectParams lists every effect and the kind of each parameter it accepts.
+var effectParams = map[string]map[string]string{
+	"S":          {"strength": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"E":          {"space": "string", "channels": "string", "mask": "mask"},
+	"B":          {"space": "string", "channels": "string", "mask": "mask"},
+	"G":          {"space": "string", "channels": "string", "mask": "mask"},
+	"U":          {"radius": "number", "amount": "number", "threshold": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"crop":       {"x": "number", "y": "number", "width": "number", "height": "number"},
+	"flipH":      {},
+	"flipV":      {},
+	"rotate":     {"angle": "number"},
+	"resize":     {"width": "number", "height": "number", "filter": "string"},
+	"brightness": {"amount": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"contrast":   {"amount": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"gamma":      {"gamma": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"saturation": {"amount": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"hue":        {"degrees": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"levels":     {"black": "number", "white": "number", "gamma": "number", "auto": "bool", "clip": "number", "space": "string", "channels": "string", "mask": "mask"},
+	"invert":     {"space": "string", "channels": "string", "mask": "mask"},
+	"equalize":   {"mask": "mask"},
+	"clahe":      {"tileSize": "number", "clipLimit": "number", "mask": "mask"},
+	"convert":    {"from": "string", "to": "string", "mask": "mask"},
+	"blend":      {"image": "image", "mode": "string", "x": "number", "y": "number", "opacity": "number", "scale": "number", "filter": "string", "mask": "mask"},
+}
+
+// Known reports whether name is a built-in effect.
+func Known(name string) bool {
+	_, ok := effectParams[name]
+	return ok
+}
+
+// Validate checks that the effect exists and that its parameters are ones it
+// accepts, of the right kind and in range.
+func (spec EffectSpec) Validate() error {
+	params, ok := effectParams[spec.Name]
+	if !ok {
+		return fmt.Errorf("unknown effect %q", spec.Name)
+	}
+	for key, value := range spec.Params {
+		kind, ok := params[key]
+		if !ok {
+			var accepted []string
+			for k := range params {
+				accepted = append(accepted, k)
+			}
+			sort.Strings(accepted)
+			return fmt.Errorf("effect %q has no parameter %q (accepts: %s)", spec.Name, key, strings.Join(accepted, ", "))
+		}
+		var valid bool
+		switch kind {
+		case "number":
+			_, valid = value.(float64)
+		case "string":
+			_, valid = value.(string)
+		case "bool":
+			_, valid = value.(bool)
+		case "image":
+			name, ok := value.(string)
+			valid = ok && name != ""
+		case "mask":
+			switch value.(type) {
+			case string, map[string]interface{}:
+				valid = true
+			}
+		}
+		if !valid {
+			switch kind {
+			case "image":
+				kind = "file name"
+			case "mask":
+				kind = "file name or shape"
+			}
+			return fmt.Errorf("effect %q parameter %q must be a %s", spec.Name, key, kind)
+		}
+	}
+	if spec.Global() && (spec.Params["space"] != nil || spec.Params["channels"] != nil) {
+		return fmt.Errorf("effect %q needs the whole image and can't be limited to channels", spec.Name)
+	}
+	if name, ok := spec.Params["mask"].(string); ok {
+		if name == "" {
+			return fmt.Errorf("effect %q has an empty mask file name", spec.Name)
+		}
+	} else if _, err := spec.maskWeight(); err != nil {
+		return fmt.Errorf("effect %q: %v", spec.Name, err)
+	}
+	if _, ok := params["space"]; ok {
+		space, ok := colorSpaces[spec.String("space", "rgb")]
+		if !ok {
+			return fmt.Errorf("unknown color space %q", spec.String("space", "rgb"))
+		}
+		keep, ok := space.selected(spec.String("channels", ""))
+		if !ok {
+			return fmt.Errorf("color space %q has no channel in %q (has: %s)", spec.String("space", "rgb"), spec.String("channels", ""), strings.Join(append(space.channels[:], "A"), ", "))
+		}
+		// Hue wraps around, so averaging it with its neighbours makes no sense
+		if keep[0] && space.channels[0] == "H" && spec.Halo() > 0 {
+			return fmt.Errorf("effect %q filters neighbouring pixels, which hue can't be; list the channels of %q without H", spec.Name, spec.String("space", "rgb"))
+		}
+	}
+	switch spec.Name {
+	case "convert":
+		for _, key := range []string{"from", "to"} {
+			if _, ok := colorSpaces[spec.String(key, "rgb")]; !ok {
+				return fmt.Errorf("unknown color space %q", spec.String(key, "rgb"))
+			}
+		}
+	case "blend":
+		if _, ok := spec.Params["image"]; !ok {
+			return fmt.Errorf("blend needs an image")
+		}
+		if _, ok := blendModes[spec.String("mode", "normal")]; !ok {
+			return fmt.Errorf("unknown blend mode %q", spec.String("mode", "normal"))
+		}
+		if o := spec.Float("opacity", 1); o < 0 || o > 1 {
+			return fmt.Errorf("blend opacity %v is outside 0-1", o)
+		}
+		if spec.Float("scale", 1) <= 0 {
+			return fmt.Errorf("blend scale must be positive")
+		}
+		if f := spec.String("filter", "bilinear"); f != "nearest" && resampleFilters[f].kernel == nil {
+			return fmt.Errorf("unknown resize filter %q", f)
+		}
+	case "crop":
+		if spec.Float("width", 0) <= 0 || spec.Float("height", 0) <= 0 {
+			return fmt.Errorf("crop needs a positive width and height")
+		}
+	case "resize":
+		if spec.Float("width", 0) < 0 || spec.Float("height", 0) < 0 {
+			return fmt.Errorf("resize width and height can't be negative")
+		}
+		if f := spec.String("filter", "bilinear"); f != "nearest" && resampleFilters[f].kernel == nil {
+			return fmt.Errorf("unknown resize filter %q", f)
+		}
+	case "gamma":
+		if spec.Float("gamma", 1) <= 0 {
+			return fmt.Errorf("gamma must be positive")
+		}
+	case "levels":
+		if spec.Float("gamma", 1) <= 0 {
+			return fmt.Errorf("levels gamma must be positive")
+		}
+	case "U":
+		if spec.Float("radius", 1) < 1 {
+			return fmt.Errorf("unsharp radius must be at least 1")
+		}
+	case "clahe":
+		if spec.Float("tileSize", 64) < 1 {
+			return fmt.Errorf("clahe tileSize must be at least 1")
+		}
+	}
+	return nil
+}
+
+// Validate checks the options for an output named name. An empty name skips
+// the format check unless a format is given explicitly.
+func (opts SaveOptions) Validate(name string) error {
+	if name != "" || opts.Format != "" {
+		format, err := FormatFor(name, opts.Format)
+		if err != nil {
+			return err
+		}
+		// The TIFF encoder writes alpha with every RGB image
+		if format == "tiff" && opts.DropAlpha && !opts.Gray {
+			return fmt.Errorf("tiff output can't drop its alpha channel")
+		}
+	}
+	switch opts.Depth {
+	case "", "source", "8", "16":
+	default:
+		return fmt.Errorf("unknown output depth %q", opts.Depth)
+	}
+	if _, ok := compressionLevels[opts.Compression]; !ok {
+		return fmt.Errorf("unknown png compression %q", opts.Compression)
+	}
+	if opts.Quality < 0 || opts.Quality > 100 {
+		return fmt.Errorf("jpeg quality %d is outside 1-100", opts.Quality)
+	}
+	for _, typ := range opts.StripMetadata {
+		if typ != "all" && !keptChunks[typ] {
+			return fmt.Errorf("unknown metadata chunk %q", typ)
+		}
+	}
+	for keyword := range opts.Text {
+		if len(keyword) == 0 || len(keyword) > 79 || strings.ContainsRune(keyword, 0) {
+			return fmt.Errorf("invalid png text keyword %q", keyword)
+		}
+	}
+	if opts.DPI < 0 {
+		return fmt.Errorf("negative resolution %v dpi", opts.DPI)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"math"
+	"proj3/png"
+	"sync"
+)
+
+// ApplyEffectsChunked runs the task's effects with the image split into numChunks
+// horizontal bands that are processed concurrently. Each band is copied out with
+// enough padding rows for every kernel in its run of effects, and AddChunk cuts the
+// padding off again when stitching. Geometric effects change the image bounds and
+// need the whole image, so they split the chain: the bands are stitched together,
+// the transform runs on the full image, and the following effects are chunked again.
+// Effects that need whole-image statistics are a barrier too, see applyGlobal.
+// The images between runs go back to the buffer pools; In and the Out the task
+// came with are left alone.
+func ApplyEffectsChunked(task *ImageTask, numChunks int) *ImageTask {
+	img := task.Image
+	e := png.NewEffects()
+	in := img.In
+	current := img.In
+	// advance moves on to the result of the next run
+	advance := func(next png.Buffer) {
+		if current != in && current != next {
+			png.PutBuffer(current)
+		}
+		current = next
+	}
+	effects := task.Effects
+	for len(effects) > 0 {
+		img.In = current
+		if effects[0].Geometric() {
+			img.Apply(effects[0], e, false, 0, 0)
+			advance(img.Out)
+			effects = effects[1:]
+			continue
+		}
+		if effects[0].Global() {
+			img.Out = png.NewBuffer(current, current.Bounds())
+			applyGlobal(img, effects[0], numChunks)
+			advance(img.Out)
+			effects = effects[1:]
+			continue
+		}
+		n := 0
+		for n < len(effects) && !wholeImage(effects[n]) {
+			n++
+		}
+		img.Out = png.NewBuffer(current, current.Bounds())
+		processChunks(img, effects[:n], numChunks)
+		advance(img.Out)
+		effects = effects[n:]
+	}
+	img.In, img.Out = in, current
+	img.Bounds = current.Bounds()
+	return task
+}
+
+// processChunks applies bounds preserving effects from img.In into img.Out, one
+// goroutine per chunk.
+func processChunks(img *png.Image, effects []png.EffectSpec, numChunks int) {
+	pad := 0
+	for _, effect := range effects {
+		pad += effect.Halo()
+	}
+	bounds := img.In.Bounds()
+	var wg sync.WaitGroup
+	for i := 0; i < numChunks; i++ {
+		start := bounds.Min.Y + i*bounds.Dy()/numChunks
+		end := bounds.Min.Y + (i+1)*bounds.Dy()/numChunks
+		if start == end {
+			continue
+		}
+		chunk := &ImageTask{
+			Effects:    effects,
+			ChunkStart: start,
+			ChunkEnd:   end,
+			Top:        i == 0,
+			Bottom:     i == numChunks-1,
+		}
+		wg.Add(1)
+		go func(chunk *ImageTask) {
+			defer wg.Done()
+			padStart := int(math.Max(float64(chunk.ChunkStart-pad), float64(bounds.Min.Y)))
+			padEnd := int(math.Min(float64(chunk.ChunkEnd+pad), float64(bounds.Max.Y)))
+			chunk.Image = img.MakeChunk(padStart, padEnd)
+			chunk.ProcessSlice()
+			AddChunk(img, chunk)
+			png.PutBuffer(chunk.Image.In)
+			png.PutBuffer(chunk.Image.Out)
+		}(chunk)
+	}
+	wg.Wait()
+}
+
+// applyGlobal runs an effect that needs whole-image statistics as a parallel
+// reduce: every chunk accumulates the statistics of its own rows, the partial
+// statistics are merged, and every chunk then maps its rows with the merged result.
+// Both passes work on the stitched image directly, since neither needs padding.
+func applyGlobal(img *png.Image, effect png.EffectSpec, numChunks int) {
+	bounds := img.In.Bounds()
+	partials := make([]*png.Stats, numChunks)
+	var wg sync.WaitGroup
+	for i := 0; i < numChunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			partials[i] = effect.NewStats(bounds)
+			img.Accumulate(partials[i], bounds.Min.Y+i*bounds.Dy()/numChunks, bounds.Min.Y+(i+1)*bounds.Dy()/numChunks)
+		}(i)
+	}
+	wg.Wait()
+	stats := partials[0]
+	for _, partial := range partials[1:] {
+		stats.Merge(partial)
+	}
+	for i := 0; i < numChunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img.ApplyGlobal(effect, stats, true, bounds.Min.Y+i*bounds.Dy()/numChunks, bounds.Min.Y+(i+1)*bounds.Dy()/numChunks)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// wholeImage reports whether an effect can't be computed chunk by chunk.
+func wholeImage(effect png.EffectSpec) bool {
+	return effect.Geometric() || effect.Global()
+}
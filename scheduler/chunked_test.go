@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"image"
+	"image/color"
+	"proj3/png"
+	"testing"
+)
+
+// testImage returns a w×h image of uneven colors with a dark band, in a float
+// buffer if float is set.
+func testImage(w int, h int, float bool) *png.Image {
+	m := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint16(x*613+y*1559) % 40000
+			if y > h/3 && y < h/2 {
+				v /= 8
+			}
+			m.SetRGBA64(x, y, color.RGBA64{v, uint16(x * 500), uint16(y * 700), 65535})
+		}
+	}
+	img := &png.Image{In: m, Bounds: m.Rect}
+	if float {
+		img.UseFloat()
+	}
+	return img
+}
+
+// sameBuffer reports whether a and b hold the same pixels.
+func sameBuffer(a png.Buffer, b png.Buffer) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	switch a := a.(type) {
+	case *image.RGBA64:
+		b, ok := b.(*image.RGBA64)
+		return ok && string(a.Pix) == string(b.Pix)
+	case *png.Float:
+		b, ok := b.(*png.Float)
+		if !ok || len(a.Pix) != len(b.Pix) {
+			return false
+		}
+		for i := range a.Pix {
+			if a.Pix[i] != b.Pix[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// TestChunkedGlobalEffects checks the parallel reduce of applyGlobal against a
+// whole-image run: partial statistics merged across chunks must map every pixel
+// exactly as the statistics of the whole image do.
+func TestChunkedGlobalEffects(t *testing.T) {
+	masks := map[string]interface{}{
+		"no mask":   nil,
+		"rectangle": map[string]interface{}{"x": 10.0, "y": 5.0, "width": 50.0, "height": 40.0},
+		"polygon":   map[string]interface{}{"points": []interface{}{[]interface{}{0.0, 0.0}, []interface{}{90.0, 20.0}, []interface{}{30.0, 60.0}}},
+	}
+	for _, name := range []string{"equalize", "clahe"} {
+		for maskName, mask := range masks {
+			spec := png.EffectSpec{Name: name, Params: map[string]interface{}{}}
+			if name == "clahe" {
+				spec.Params["tileSize"] = 16.0
+			}
+			if mask != nil {
+				spec.Params["mask"] = mask
+			}
+			if err := spec.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			effects := []png.EffectSpec{spec}
+			for _, float := range []bool{false, true} {
+				whole := testImage(97, 61, float)
+				whole.Out = png.NewBuffer(whole.In, whole.In.Bounds())
+				whole.ApplyEffects(effects, false, 0, 0)
+				for _, chunks := range []int{2, 3, 7} {
+					img := testImage(97, 61, float)
+					ApplyEffectsChunked(&ImageTask{Effects: effects, Image: img}, chunks)
+					if !sameBuffer(img.Out, whole.Out) {
+						t.Errorf("%s, %s, float %v: %d chunks differ from the whole image", name, maskName, float, chunks)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Globber is implemented by sources that can list their input images, which
+// tasks with an inGlob or inDir need. Matches are slash separated paths relative
+// to the size's input root, in the form ImageTask.InPath takes.
+type Globber interface {
+	Glob(size string, pattern string) ([]string, error)
+}
+
+func (src DirSource) Glob(size string, pattern string) ([]string, error) {
+	root := filepath.Join(src.InDir, size)
+	var matches []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); matchGlob(pattern, rel) {
+			matches = append(matches, rel)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+func (src MemorySource) Glob(size string, pattern string) ([]string, error) {
+	var matches []string
+	for key := range src.Images {
+		if rel := strings.TrimPrefix(key, size+"/"); rel != key && matchGlob(pattern, rel) {
+			matches = append(matches, rel)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchGlob reports whether a slash separated path matches pattern. Segments
+// match as in path.Match, and a "**" segment matches any number of directories.
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// imageExts are the input extensions an inDir task picks up.
+var imageExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".bmp": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+// expand turns a task with an inGlob or inDir into one task per matching input of
+// its size. Any other task is returned as is.
+func (task *ImageTask) expand(src Source) ([]*ImageTask, error) {
+	pattern := task.InGlob
+	if task.InDir != "" {
+		pattern = strings.TrimSuffix(task.InDir, "/") + "/**/*"
+	}
+	if pattern == "" {
+		return []*ImageTask{task}, nil
+	}
+	globber, ok := src.(Globber)
+	if !ok {
+		return nil, fmt.Errorf("source can't list inputs for %q", pattern)
+	}
+	matches, err := globber.Glob(task.Size, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*ImageTask
+	for _, match := range matches {
+		if task.InDir != "" && !imageExts[strings.ToLower(path.Ext(match))] {
+			continue
+		}
+		expanded := *task
+		expanded.InPath = match
+		expanded.InGlob, expanded.InDir = "", ""
+		if expanded.OutTemplate == "" {
+			// Mirror the input tree under the output root
+			expanded.OutTemplate = "{size}/{dir}/{stem}{ext}"
+			if len(expanded.Outputs) > 0 {
+				expanded.OutTemplate = "{size}/{dir}/{stem}_{output}{ext}"
+			}
+		}
+		tasks = append(tasks, &expanded)
+	}
+	return tasks, nil
+}
+
+// outputName is the path of a task's output relative to the sink's root. Without
+// an outTemplate it is "<size>_<outPath>". A template may use {size}, {dir} (the
+// input's directory), {stem} and {ext} (its file name without and with only the
+// extension), {name} (the whole file name), {out} (the task's outPath) and
+// {output} (the name of the output, see Output).
+func outputName(task *ImageTask) string {
+	if task.OutTemplate == "" {
+		return task.Size + "_" + task.OutPath
+	}
+	dir, name := path.Split(task.InPath)
+	ext := path.Ext(name)
+	r := strings.NewReplacer(
+		"{size}", task.Size,
+		"{dir}", strings.TrimSuffix(dir, "/"),
+		"{stem}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+		"{name}", name,
+		"{out}", task.OutPath,
+		"{output}", task.output,
+	)
+	return path.Clean(r.Replace(task.OutTemplate))
+}
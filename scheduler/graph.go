@@ -0,0 +1,162 @@
+package scheduler
+
+import (
+	"fmt"
+	"proj3/png"
+	"sort"
+	"strings"
+)
+
+// Graph lets a task run its effects as a graph instead of a chain. Each node runs
+// a chain of effects on the result of another node, or on the decoded input, so
+// one result can feed several nodes. Inside a node, an image parameter written as
+// "@name" takes the result of node name instead of an image file, which gives
+// nodes like blend several inputs:
+//
+//	"graph": {
+//	  "nodes": {
+//	    "soft":  {"effects": ["B"]},
+//	    "edges": {"input": "soft", "effects": ["E"]},
+//	    "glow":  {"input": "soft", "effects": [{"name": "blend", "image": "@edges", "mode": "screen"}]}
+//	  },
+//	  "output": "glow"
+//	}
+//
+// Nodes that don't depend on each other run concurrently, except in "s" mode, and
+// every result is dropped as soon as the last node or output reading it is done.
+type Graph struct {
+	Nodes  map[string]Node `json:"nodes"`
+	Output string          `json:"output"` // the node the task saves, or outputs start from by default
+}
+
+// Node is a chain of effects in a Graph.
+type Node struct {
+	Input   string           `json:"input"` // the node the effects run on, the decoded input if empty or "input"
+	Effects []png.EffectSpec `json:"effects"`
+}
+
+// inputNode names the decoded input in a graph.
+const inputNode = "input"
+
+// refs returns the nodes whose results the node's effects take as images, sorted.
+func (node Node) refs() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, effect := range node.Effects {
+		for _, name := range nodeRefs(effect) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nodeRefs returns the nodes an effect's image parameters refer to.
+func nodeRefs(effect png.EffectSpec) []string {
+	var names []string
+	for _, key := range effect.ImageFiles() {
+		if name := effect.String(key, ""); strings.HasPrefix(name, "@") {
+			names = append(names, name[1:])
+		}
+	}
+	return names
+}
+
+// validate checks that every node exists, that the graph has no cycles and that
+// the effects of the nodes are valid.
+func (g *Graph) validate() error {
+	if len(g.Nodes) == 0 {
+		return fmt.Errorf("graph has no nodes")
+	}
+	exists := func(name string) bool {
+		_, ok := g.Nodes[name]
+		return ok || name == "" || name == inputNode
+	}
+	if !exists(g.Output) {
+		return fmt.Errorf("graph output %q is not a node", g.Output)
+	}
+	names := make([]string, 0, len(g.Nodes))
+	for name := range g.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		node := g.Nodes[name]
+		if name == "" || name == inputNode {
+			return fmt.Errorf("graph node name %q is reserved", name)
+		}
+		if !exists(node.Input) {
+			return fmt.Errorf("graph node %q reads node %q, which doesn't exist", name, node.Input)
+		}
+		for _, effect := range node.Effects {
+			if err := effect.Validate(); err != nil {
+				return fmt.Errorf("graph node %q: %v", name, err)
+			}
+			for _, ref := range nodeRefs(effect) {
+				if !exists(ref) {
+					return fmt.Errorf("graph node %q refers to node %q, which doesn't exist", name, ref)
+				}
+			}
+		}
+	}
+	// Depth first search for a node that is its own ancestor
+	state := make(map[string]int) // 1 while visiting, 2 when done
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if name == "" || name == inputNode || state[name] == 2 {
+			return nil
+		}
+		if state[name] == 1 {
+			return fmt.Errorf("graph has a cycle through %s", strings.Join(append(path, name), ", "))
+		}
+		state[name] = 1
+		node := g.Nodes[name]
+		for _, dep := range append([]string{node.Input}, node.refs()...) {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stages returns a stage, run on img, for each of the nodes needed and those they
+// depend on, keyed by node name. The decoded input is under "" and "input". Other
+// nodes are left out so they hold on to nothing.
+func (g *Graph) stages(img *png.Image, needed []string) map[string]*stage {
+	root := &stage{image: img}
+	stages := map[string]*stage{"": root, inputNode: root}
+	var build func(name string) *stage
+	build = func(name string) *stage {
+		if s, ok := stages[name]; ok {
+			return s
+		}
+		node := g.Nodes[name]
+		s := &stage{image: img, effects: node.Effects}
+		stages[name] = s
+		s.parent = build(node.Input)
+		s.parent.users++
+		for _, ref := range node.refs() {
+			if s.refs == nil {
+				s.refs = make(map[string]*stage)
+			}
+			s.refs[ref] = build(ref)
+			s.refs[ref].users++
+		}
+		return s
+	}
+	for _, name := range needed {
+		build(name)
+	}
+	return stages
+}
@@ -0,0 +1,48 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"testing"
+)
+
+// TestLinearGraphBlend blends mid gray at half opacity over white in linear light,
+// once from a file and once from a graph node, which should both give the same.
+func TestLinearGraphBlend(t *testing.T) {
+	encode := func(colors ...color.Color) []byte {
+		m := image.NewNRGBA(image.Rect(0, 0, len(colors), 1))
+		for x, c := range colors {
+			m.Set(x, 0, c)
+		}
+		var buf bytes.Buffer
+		stdpng.Encode(&buf, m)
+		return buf.Bytes()
+	}
+	gray, white := color.NRGBA{128, 128, 128, 255}, color.NRGBA{255, 255, 255, 255}
+	job := `{"inPath": "in.png", "outPath": "file.png", "linear": true, "effects": [{"name": "blend", "image": "gray.png", "x": 1, "opacity": 0.5}]}
+{"inPath": "in.png", "outPath": "graph.png", "linear": true, "graph": {"nodes": {"top": {"effects": [{"name": "blend", "image": "@input", "x": 1, "opacity": 0.5}]}}, "output": "top"}}
+`
+	sink := &MemorySink{}
+	Schedule(Config{
+		DataDirs: "small",
+		Mode:     "s",
+		Source: MemorySource{
+			Effects:  []byte(job),
+			Includes: map[string][]byte{"gray.png": encode(gray)},
+			Images:   map[string][]byte{"small/in.png": encode(gray, white)},
+		},
+		Sink: sink,
+	})
+	for _, name := range []string{"small_file.png", "small_graph.png"} {
+		m, err := stdpng.Decode(bytes.NewReader(sink.Outputs[name]))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// Gray 128 is 0.216 in linear light, (0.216 + 1) / 2 is 205 in sRGB
+		if r, _, _, _ := m.At(1, 0).RGBA(); r>>8 != 205 {
+			t.Errorf("%s: the blend gave %d, want 205", name, r>>8)
+		}
+	}
+}
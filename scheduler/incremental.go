@@ -0,0 +1,237 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"proj3/png"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sources and sinks that can report modification times support the "mtime"
+// incremental mode; a sink that can report them is also needed for "hash" mode to
+// know the output still exists.
+type sourceTimes interface {
+	TasksModTime() (time.Time, error)
+	InputModTime(task *ImageTask) (time.Time, error)
+	FileModTime(name string) (time.Time, error) // a job or image file, named as for OpenJob
+}
+
+type sinkTimes interface {
+	OutputModTime(task *ImageTask) (time.Time, error)
+}
+
+func (src DirSource) TasksModTime() (time.Time, error) {
+	return modTime(src.EffectsPath)
+}
+
+func (src DirSource) InputModTime(task *ImageTask) (time.Time, error) {
+	return modTime(filepath.Join(src.InDir, task.Size, task.InPath))
+}
+
+func (src DirSource) FileModTime(name string) (time.Time, error) {
+	return modTime(filepath.FromSlash(name))
+}
+
+func (sink DirSink) OutputModTime(task *ImageTask) (time.Time, error) {
+	return modTime(filepath.Join(sink.OutDir, outputName(task)))
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// incremental decides which tasks of a run can be skipped. In "mtime" mode a task
+// is skipped when its output is newer than its input, the effects list, and the
+// included job files and image files it is made from (see ImageTask.deps).
+// In "hash" mode it is skipped when its output exists and the hash of its input
+// bytes and effect chain matches the one recorded in the manifest when the output
+// was written. A nil *incremental skips nothing.
+type incremental struct {
+	mode      string
+	source    Source
+	sink      Sink
+	tasksTime time.Time
+	path      string
+
+	mu        sync.Mutex
+	manifest  map[string]string    // output name -> input and chain hash
+	fileTimes map[string]time.Time // modification times of deps already looked up
+}
+
+// newIncremental prepares the incremental state of a run, or returns nil if the
+// configuration doesn't ask for one. A mode that can't work with the source stops
+// the run rather than processing everything again.
+func newIncremental(config Config) *incremental {
+	if config.Incremental == "" {
+		return nil
+	}
+	inc := &incremental{mode: config.Incremental, source: config.source(), sink: config.sink(), path: config.Manifest}
+	switch inc.mode {
+	case "mtime":
+		times, ok := inc.source.(sourceTimes)
+		if !ok {
+			log.Fatalf("error starting incremental run: mtime mode needs a source that reports modification times")
+		}
+		t, err := times.TasksModTime()
+		if err != nil {
+			log.Fatalf("error starting incremental run: %v", err)
+		}
+		inc.tasksTime = t
+	case "hash":
+		if inc.path == "" {
+			inc.path = "../data/out/.manifest.json"
+		}
+		inc.manifest = make(map[string]string)
+		if data, err := os.ReadFile(inc.path); err == nil {
+			json.Unmarshal(data, &inc.manifest)
+		}
+	default:
+		panic("Invalid incremental mode given.")
+	}
+	return inc
+}
+
+// outputTime returns when the task's output was written, or false if it doesn't exist.
+func (inc *incremental) outputTime(task *ImageTask) (time.Time, bool) {
+	times, ok := inc.sink.(sinkTimes)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := times.OutputModTime(task)
+	return t, err == nil
+}
+
+// fresh reports, before the input is read, whether an "mtime" run can skip the task.
+func (inc *incremental) fresh(task *ImageTask) bool {
+	if inc == nil || inc.mode != "mtime" {
+		return false
+	}
+	out, ok := inc.outputTime(task)
+	if !ok {
+		return false
+	}
+	in, err := inc.source.(sourceTimes).InputModTime(task)
+	if err != nil || !out.After(in) || !out.After(inc.tasksTime) {
+		return false
+	}
+	for _, name := range task.deps {
+		t, ok := inc.fileTime(name)
+		if !ok || !out.After(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileTime returns when a job or image file was last changed, looking each one up
+// once per run, or false if it can't be.
+func (inc *incremental) fileTime(name string) (time.Time, bool) {
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	if t, ok := inc.fileTimes[name]; ok {
+		return t, true
+	}
+	t, err := inc.source.(sourceTimes).FileModTime(name)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if inc.fileTimes == nil {
+		inc.fileTimes = make(map[string]time.Time)
+	}
+	inc.fileTimes[name] = t
+	return t, true
+}
+
+// unchanged reports, given the input bytes, whether a "hash" run can skip the task.
+// Otherwise it remembers the task's hash so record can store it once saved.
+func (inc *incremental) unchanged(task *ImageTask, input []byte) bool {
+	if inc == nil || inc.mode != "hash" {
+		return false
+	}
+	task.hash = taskHash(task, input)
+	if _, ok := inc.outputTime(task); !ok {
+		return false
+	}
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	return inc.manifest[outputName(task)] == task.hash
+}
+
+// record notes that the task's output was written.
+func (inc *incremental) record(task *ImageTask) {
+	if inc == nil || inc.mode != "hash" {
+		return
+	}
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	inc.manifest[outputName(task)] = task.hash
+}
+
+// flush writes the manifest back at the end of a "hash" run.
+func (inc *incremental) flush() {
+	if inc == nil || inc.mode != "hash" {
+		return
+	}
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	data, err := json.MarshalIndent(inc.manifest, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	f, err := png.CreateAtomic(inc.path)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Abort()
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+}
+
+// taskHash hashes the input bytes together with everything that shapes the output,
+// including the pixels of the image files the effects of the task and of its graph
+// nodes read.
+func taskHash(task *ImageTask, input []byte) string {
+	chain, err := json.Marshal(struct {
+		Effects       []png.EffectSpec
+		Graph         *Graph
+		Node          string
+		Premultiplied bool
+		Provenance    bool
+		AutoOrient    bool
+		Linear        bool
+		Buffer        string
+		Save          png.SaveOptions
+	}{task.Effects, task.Graph, task.node, task.Premultiplied, task.Provenance, task.AutoOrient, task.Linear, task.Buffer, task.SaveOptions})
+	if err != nil {
+		panic(err)
+	}
+	h := sha256.New()
+	h.Write(input)
+	h.Write(chain)
+	png.HashImages(h, task.Effects)
+	if task.Graph != nil {
+		names := make([]string, 0, len(task.Graph.Nodes))
+		for name := range task.Graph.Nodes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			png.HashImages(h, task.Graph.Nodes[name].Effects)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
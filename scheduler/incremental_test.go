@@ -0,0 +1,87 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"os"
+	"path/filepath"
+	"proj3/png"
+	"testing"
+	"time"
+)
+
+func TestTaskHashCoversGraphImages(t *testing.T) {
+	hash := func(gray uint16) string {
+		overlay := image.NewRGBA64(image.Rect(0, 0, 2, 2))
+		overlay.SetRGBA64(0, 0, color.RGBA64{gray, gray, gray, 65535})
+		blend := png.EffectSpec{Name: "blend", Params: map[string]interface{}{"image": "overlay.png"}, Images: map[string]png.Buffer{"image": overlay}}
+		task := &ImageTask{Graph: &Graph{Nodes: map[string]Node{"top": {Effects: []png.EffectSpec{blend}}}, Output: "top"}}
+		return taskHash(task, []byte("input"))
+	}
+	if hash(0) == hash(65535) {
+		t.Error("changing the image a graph node blends in left the task hash as it was")
+	}
+}
+
+// TestMtimeCoversJobFiles checks that an mtime run redoes a task once an included
+// job file or a mask it names is newer than its output, and skips it otherwise.
+func TestMtimeCoversJobFiles(t *testing.T) {
+	dir := t.TempDir()
+	var encoded bytes.Buffer
+	stdpng.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 4)))
+	files := map[string]string{
+		"job.json":        `{"include": ["presets.json"], "tasks": [{"inPath": "in.png", "outPath": "out.png", "effects": ["soft", {"name": "B", "mask": "mask.png"}]}]}`,
+		"presets.json":    `{"presets": {"soft": ["S"]}}`,
+		"mask.png":        encoded.String(),
+		"in/small/in.png": encoded.String(),
+	}
+	past := time.Now().Add(-time.Hour)
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(name, past, past)
+	}
+	out := filepath.Join(dir, "out", "small_out.png")
+	// run runs the job and reports whether it wrote the output, which it dates to
+	// a known time either way
+	written := past.Add(10 * time.Minute)
+	run := func() bool {
+		Schedule(Config{
+			DataDirs:    "small",
+			Mode:        "s",
+			Source:      DirSource{EffectsPath: filepath.Join(dir, "job.json"), InDir: filepath.Join(dir, "in")},
+			Sink:        DirSink{OutDir: filepath.Join(dir, "out")},
+			Incremental: "mtime",
+		})
+		info, err := os.Stat(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrote := !info.ModTime().Equal(written)
+		os.Chtimes(out, written, written)
+		return wrote
+	}
+	if !run() {
+		t.Fatal("the first run didn't write the output")
+	}
+	if run() {
+		t.Error("a run with nothing changed wrote the output")
+	}
+	for _, name := range []string{"presets.json", "mask.png"} {
+		later := written.Add(time.Minute)
+		os.Chtimes(filepath.Join(dir, name), later, later)
+		if !run() {
+			t.Errorf("a run after changing %s didn't write the output", name)
+		}
+		written = later.Add(time.Minute)
+		os.Chtimes(out, written, written)
+		if run() {
+			t.Errorf("a run after the output was redone for %s wrote it again", name)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"proj3/png"
+	"sync"
+	"sync/atomic"
+)
+
+// Source supplies the work for a run: the effects list and the input image of
+// every task. Setting Config.Source lets the schedulers read from archives,
+// network bodies or in-memory fixtures instead of the data directory.
+type Source interface {
+	Tasks() (io.ReadCloser, error)               // newline delimited JSON ImageTasks
+	Open(task *ImageTask) (io.ReadCloser, error) // the encoded input image of a task
+}
+
+// Sink receives the encoded output image of every task. If the writer it returns
+// also has an Abort() error method, it is called instead of Close when encoding
+// fails, so a partial image is never published.
+type Sink interface {
+	Create(task *ImageTask) (io.WriteCloser, error)
+}
+
+type aborter interface {
+	Abort() error
+}
+
+// DirSource reads the effects file and the <InDir>/<size>/<inPath> layout on disk.
+type DirSource struct {
+	EffectsPath string
+	InDir       string
+}
+
+func (src DirSource) Tasks() (io.ReadCloser, error) {
+	return os.Open(src.EffectsPath)
+}
+
+func (src DirSource) Open(task *ImageTask) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(src.InDir, task.Size, task.InPath))
+}
+
+// DirSink writes every output atomically to its outputName under OutDir,
+// creating directories as needed.
+type DirSink struct {
+	OutDir string
+}
+
+func (sink DirSink) Create(task *ImageTask) (io.WriteCloser, error) {
+	path := filepath.Join(sink.OutDir, filepath.FromSlash(outputName(task)))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return png.CreateAtomic(path)
+}
+
+// MemorySource serves the effects list and input images from memory. Images are
+// keyed by "<size>/<inPath>". Name is the job file name Effects is read as
+// ("effects.txt" if empty), and Includes holds the job files it may include.
+type MemorySource struct {
+	Name     string
+	Effects  []byte
+	Includes map[string][]byte
+	Images   map[string][]byte
+}
+
+func (src MemorySource) Tasks() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(src.Effects)), nil
+}
+
+func (src MemorySource) Open(task *ImageTask) (io.ReadCloser, error) {
+	data, ok := src.Images[task.Size+"/"+task.InPath]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: task.Size + "/" + task.InPath, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// MemorySink collects outputs in memory, keyed by their outputName. It is safe
+// for concurrent use by the parallel schedulers.
+type MemorySink struct {
+	mu      sync.Mutex
+	Outputs map[string][]byte
+}
+
+func (sink *MemorySink) Create(task *ImageTask) (io.WriteCloser, error) {
+	return &memoryFile{sink: sink, name: outputName(task)}, nil
+}
+
+// memoryFile buffers one output and hands it to its sink on Close.
+type memoryFile struct {
+	bytes.Buffer
+	sink *MemorySink
+	name string
+}
+
+func (f *memoryFile) Close() error {
+	f.sink.mu.Lock()
+	defer f.sink.mu.Unlock()
+	if f.sink.Outputs == nil {
+		f.sink.Outputs = make(map[string][]byte)
+	}
+	f.sink.Outputs[f.name] = f.Bytes()
+	return nil
+}
+
+// source returns the configured Source, defaulting to the data directory.
+func (config Config) source() Source {
+	if config.Source != nil {
+		return config.Source
+	}
+	return DirSource{EffectsPath: "../data/effects.txt", InDir: "../data/in/"}
+}
+
+// sink returns the configured Sink, defaulting to the data directory.
+func (config Config) sink() Sink {
+	if config.Sink != nil {
+		return config.Sink
+	}
+	return DirSink{OutDir: "../data/out/"}
+}
+
+// load decodes the task's input image from the source. In an incremental run it
+// returns false without decoding if the task's outputs are already up to date.
+func (task *ImageTask) load(src Source, inc *incremental) (bool, error) {
+	var stale []*ImageTask
+	for _, out := range task.outputs() {
+		if !inc.fresh(out) {
+			stale = append(stale, out)
+		}
+	}
+	if len(stale) == 0 {
+		return false, nil
+	}
+	r, err := src.Open(task)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	task.due = nil
+	for _, out := range stale {
+		if !inc.unchanged(out, data) {
+			task.due = append(task.due, out)
+		}
+	}
+	if len(task.due) == 0 {
+		return false, nil
+	}
+	anim, err := png.DecodeAnimation(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if anim != nil {
+		for _, frame := range anim.Frames {
+			task.prepare(frame.Image)
+		}
+		task.animation = &animation{Animation: anim, remaining: int32(len(anim.Frames))}
+		task.Image = anim.Frames[0].Image
+		return true, nil
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	task.prepare(img)
+	task.Image = img
+	return true, nil
+}
+
+// prepare gets a freshly decoded image ready for the task's effects, giving the
+// buffers it replaces back to the pools.
+func (task *ImageTask) prepare(img *png.Image) {
+	step := func(f func()) {
+		in, out := img.In, img.Out
+		f()
+		for _, m := range []png.Buffer{in, out} {
+			if m != img.In && m != img.Out {
+				png.PutBuffer(m)
+			}
+		}
+	}
+	if task.AutoOrient {
+		step(img.AutoOrient)
+	}
+	switch {
+	case task.Linear:
+		step(img.Linearize)
+	case task.Buffer != "rgba64":
+		step(img.UseFloat)
+	}
+}
+
+// animation is an animated input split into one task per frame. The frame tasks
+// run through the scheduler like any other, and the last one done saves it.
+type animation struct {
+	*png.Animation
+	remaining int32 // frames whose effects haven't finished
+}
+
+// frames returns a task per frame of an animated input, or the task itself for a
+// still image.
+func (task *ImageTask) frames() []*ImageTask {
+	if task.animation == nil {
+		return []*ImageTask{task}
+	}
+	frames := make([]*ImageTask, len(task.animation.Frames))
+	for i, frame := range task.animation.Frames {
+		t := *task
+		t.Image = frame.Image
+		frames[i] = &t
+	}
+	return frames
+}
+
+// save encodes the processed image into the sink with the task's encoder settings.
+// The format defaults to the one the output name's extension names.
+func (task *ImageTask) save(sink Sink, inc *incremental) bool {
+	// Frames wait for the rest of their animation
+	if task.animation != nil && atomic.AddInt32(&task.animation.remaining, -1) > 0 {
+		return true
+	}
+	opts := task.SaveOptions
+	format, err := png.FormatFor(outputName(task), opts.Format)
+	if err != nil {
+		panic(err)
+	}
+	opts.Format = format
+	if task.Provenance {
+		opts.Text = provenance(task, opts.Text)
+	}
+	w, err := sink.Create(task)
+	if err != nil {
+		panic(err)
+	}
+	if task.animation != nil {
+		err = task.animation.Encode(w, opts)
+	} else {
+		err = task.Image.Encode(w, opts)
+	}
+	if err != nil {
+		if a, ok := w.(aborter); ok {
+			a.Abort()
+		} else {
+			w.Close()
+		}
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	inc.record(task)
+	task.recycle()
+	return true
+}
+
+// recycle gives the images of a saved task back to the buffer pools. An output
+// whose Out is a stage's result as is, which runEffects marks by leaving In set
+// to it, lets the stage go now instead. The frames of an animation are left to
+// the garbage collector, as they share their images with the animation.
+func (task *ImageTask) recycle() {
+	if task.animation != nil {
+		return
+	}
+	img := task.Image
+	if task.stage != nil {
+		if img.Out == img.In {
+			task.stage.release()
+		} else {
+			png.PutBuffer(img.Out)
+		}
+		img.In, img.Out = nil, nil
+		return
+	}
+	png.PutBuffer(img.In)
+	if img.Out != img.In {
+		png.PutBuffer(img.Out)
+	}
+	img.In, img.Out = nil, nil
+}
+
+// provenanceKeyword is the png text keyword the effect chain is recorded under.
+const provenanceKeyword = "FastConv-Effects"
+
+// provenance returns text with the task's effect chain added as JSON, leaving the
+// task's own map alone. A graph task records its graph and the node the chain
+// starts from as well.
+func provenance(task *ImageTask, text map[string]string) map[string]string {
+	var record interface{} = task.Effects
+	if task.Graph != nil {
+		record = struct {
+			Graph   *Graph           `json:"graph"`
+			Node    string           `json:"node"`
+			Effects []png.EffectSpec `json:"effects"`
+		}{task.Graph, task.node, task.Effects}
+	}
+	chain, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+	merged := map[string]string{provenanceKeyword: string(chain)}
+	for keyword, value := range text {
+		merged[keyword] = value
+	}
+	return merged
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"proj3/png"
+	"testing"
+	"time"
+)
+
+// TestAnimationRoundTrip inverts an animated GIF and an APNG built from it, saving
+// each both ways. Every output frame must be the inverted input frame, with the
+// input's frame count, delays and disposals.
+func TestAnimationRoundTrip(t *testing.T) {
+	red, green, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	magenta := color.RGBA{255, 0, 255, 255}
+	pal := color.Palette{red, green, blue, magenta, color.Transparent}
+	rect := func(r image.Rectangle, c color.Color) *image.Paletted {
+		m := image.NewPaletted(r, pal)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m.Set(x, y, c)
+			}
+		}
+		return m
+	}
+	// A red background, a blue square cleared after it, a green patch the canvas
+	// goes back from, and a magenta one that lands on the cleared square
+	var gifIn bytes.Buffer
+	gif.EncodeAll(&gifIn, &gif.GIF{
+		Image:    []*image.Paletted{rect(image.Rect(0, 0, 6, 4), red), rect(image.Rect(1, 1, 3, 3), blue), rect(image.Rect(3, 0, 6, 2), green), rect(image.Rect(0, 2, 2, 4), magenta)},
+		Delay:    []int{10, 20, 35, 5},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone},
+	})
+	want, err := png.DecodeAnimation(bytes.NewReader(gifIn.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apngIn bytes.Buffer
+	for _, frame := range want.Frames {
+		frame.Image.Out = frame.Image.In
+	}
+	if err := want.Encode(&apngIn, png.SaveOptions{Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := `{"inPath": "in.gif", "outPath": "gif.gif", "effects": ["invert"]}
+{"inPath": "in.gif", "outPath": "gif.png", "effects": ["invert"]}
+{"inPath": "in.png", "outPath": "png.gif", "effects": ["invert"]}
+{"inPath": "in.png", "outPath": "png.png", "effects": ["invert"]}
+`
+	for _, mode := range []string{"s", "parDeque"} {
+		sink := &MemorySink{}
+		Schedule(Config{
+			DataDirs:    "small",
+			Mode:        mode,
+			ThreadCount: 3,
+			Source: MemorySource{
+				Effects: []byte(job),
+				Images:  map[string][]byte{"small/in.gif": gifIn.Bytes(), "small/in.png": apngIn.Bytes()},
+			},
+			Sink: sink,
+		})
+		for _, name := range []string{"small_gif.gif", "small_gif.png", "small_png.gif", "small_png.png"} {
+			got, err := png.DecodeAnimation(bytes.NewReader(sink.Outputs[name]))
+			if err != nil || got == nil {
+				t.Fatalf("%s, %s: decoded %v, %v", mode, name, got, err)
+			}
+			if len(got.Frames) != len(want.Frames) {
+				t.Fatalf("%s, %s: %d frames, want %d", mode, name, len(got.Frames), len(want.Frames))
+			}
+			for i, frame := range got.Frames {
+				if w := want.Frames[i]; frame.Delay != w.Delay || frame.Disposal != w.Disposal {
+					t.Errorf("%s, %s: frame %d has delay %v and disposal %d, want %v and %d", mode, name, i, frame.Delay, frame.Disposal, w.Delay, w.Disposal)
+				}
+				m, src := frame.Image.In, want.Frames[i].Image.In
+				bounds := src.Bounds()
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					for x := bounds.Min.X; x < bounds.Max.X; x++ {
+						c := color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+						if c.A != 0 {
+							c.R, c.G, c.B = 255-c.R, 255-c.G, 255-c.B
+						}
+						if got := color.RGBAModel.Convert(m.At(x, y)); got != c {
+							t.Errorf("%s, %s: frame %d (%d, %d) is %v, want %v", mode, name, i, x, y, got, c)
+						}
+					}
+				}
+			}
+		}
+	}
+	if want.Frames[1].Delay != 200*time.Millisecond || want.Frames[2].Disposal != png.DisposePrevious {
+		t.Errorf("the input decoded with frame 1 delay %v and frame 2 disposal %d", want.Frames[1].Delay, want.Frames[2].Disposal)
+	}
+}
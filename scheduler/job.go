@@ -0,0 +1,607 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"proj3/png"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// A job file lists the tasks of a run. It is either newline delimited JSON
+// ImageTasks, the original effects.txt format, or a JSON, YAML or TOML document
+// (picked by file extension) with these keys:
+//
+//	include: other job files, relative to this one, whose presets and tasks come first
+//	presets: named effect lists that any task can use by name in its effects
+//	tasks:   the ImageTasks
+//
+// A job is parsed and validated completely before anything runs, and every
+// problem found is reported with its file and line.
+
+// JobSource is implemented by sources whose effects list is a named file, which
+// lets the loader pick the format by extension and open included files.
+type JobSource interface {
+	JobName() string
+	OpenJob(name string) (io.ReadCloser, error)
+}
+
+func (src DirSource) JobName() string {
+	return src.EffectsPath
+}
+
+func (src DirSource) OpenJob(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(name))
+}
+
+func (src MemorySource) JobName() string {
+	if src.Name == "" {
+		return "effects.txt"
+	}
+	return src.Name
+}
+
+func (src MemorySource) OpenJob(name string) (io.ReadCloser, error) {
+	if name == src.JobName() {
+		return src.Tasks()
+	}
+	data, ok := src.Includes[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// JobError lists every problem found in a job.
+type JobError []string
+
+func (e JobError) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// jobEntry is a task or preset as parsed, before it is decoded and validated.
+type jobEntry struct {
+	file  string
+	line  int
+	value interface{}
+}
+
+// jobDoc is one parsed job file.
+type jobDoc struct {
+	include []string
+	presets map[string]jobEntry
+	tasks   []jobEntry
+}
+
+// LoadTasks reads and validates the job of a source.
+func LoadTasks(src Source) ([]*ImageTask, error) {
+	if job, ok := src.(JobSource); ok {
+		return LoadJob(job.JobName(), job.OpenJob)
+	}
+	return LoadJob("effects.txt", func(string) (io.ReadCloser, error) { return src.Tasks() })
+}
+
+// LoadJob reads the job file name, and the files it includes, through open.
+func LoadJob(name string, open func(name string) (io.ReadCloser, error)) ([]*ImageTask, error) {
+	presets := make(map[string]jobEntry)
+	var entries []jobEntry
+	var files []string // every job file read, since presets reach across them
+	var errs JobError
+	var load func(name string, including []string) error
+	load = func(name string, including []string) error {
+		for _, parent := range including {
+			if parent == name {
+				return fmt.Errorf("%s: include cycle through %s", name, strings.Join(including, ", "))
+			}
+		}
+		r, err := open(name)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		doc, err := parseJob(name, data)
+		if err != nil {
+			return err
+		}
+		files = append(files, name)
+		for _, include := range doc.include {
+			if !path.IsAbs(include) {
+				include = path.Join(path.Dir(filepath.ToSlash(name)), include)
+			}
+			if err := load(include, append(including, name)); err != nil {
+				return err
+			}
+		}
+		for presetName, preset := range doc.presets {
+			presets[presetName] = preset
+		}
+		entries = append(entries, doc.tasks...)
+		return nil
+	}
+	if err := load(name, nil); err != nil {
+		return nil, err
+	}
+
+	// Presets are decoded up front so every task sees the same, validated lists
+	resolved := make(map[string][]png.EffectSpec)
+	for presetName, preset := range presets {
+		if png.Known(presetName) {
+			errs = append(errs, fmt.Sprintf("%s:%d: preset %q shadows the effect of the same name", preset.file, preset.line, presetName))
+			continue
+		}
+		var effects []png.EffectSpec
+		if err := roundTrip(preset.value, &effects); err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: preset %q: %v", preset.file, preset.line, presetName, err))
+			continue
+		}
+		resolved[presetName] = effects
+	}
+
+	var tasks []*ImageTask
+	images := make(map[string]png.Buffer)
+	for i, entry := range entries {
+		task := &ImageTask{}
+		if err := roundTrip(entry.value, task); err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: task %d: %v", entry.file, entry.line, i+1, err))
+			continue
+		}
+		effects, err := expandPresets(task.Effects, resolved, nil)
+		if err == nil {
+			task.Effects = effects
+			for i := 0; i < len(task.Outputs) && err == nil; i++ {
+				task.Outputs[i].Effects, err = expandPresets(task.Outputs[i].Effects, resolved, nil)
+			}
+		}
+		if err == nil && task.Graph != nil {
+			for name, node := range task.Graph.Nodes {
+				if node.Effects, err = expandPresets(node.Effects, resolved, nil); err != nil {
+					break
+				}
+				task.Graph.Nodes[name] = node
+			}
+		}
+		if err == nil {
+			err = task.validate()
+		}
+		task.deps = append([]string(nil), files...)
+		if err == nil {
+			err = loadImages(task, task.Effects, entry.file, open, images)
+			for i := 0; i < len(task.Outputs) && err == nil; i++ {
+				err = loadImages(task, task.Outputs[i].Effects, entry.file, open, images)
+			}
+		}
+		if err == nil && task.Graph != nil {
+			for _, node := range task.Graph.Nodes {
+				if err = loadImages(task, node.Effects, entry.file, open, images); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: task %d: %v", entry.file, entry.line, i+1, err))
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return tasks, nil
+}
+
+// loadImages decodes the image files effects of task name, relative to the job
+// file of the task, and adds them to its deps. Each file is decoded once, prepared
+// once for every way effects read it (see png.EffectSpec.PrepareImage) and shared
+// read-only by every effect that names it. Graph node references ("@name") are
+// left for the graph to fill in.
+func loadImages(task *ImageTask, effects []png.EffectSpec, file string, open func(name string) (io.ReadCloser, error), loaded map[string]png.Buffer) error {
+	linear := task.Linear
+	for i, effect := range effects {
+		for _, key := range effect.ImageFiles() {
+			name := effect.String(key, "")
+			if strings.HasPrefix(name, "@") {
+				continue
+			}
+			if !path.IsAbs(name) {
+				name = path.Join(path.Dir(filepath.ToSlash(file)), name)
+			}
+			task.deps = append(task.deps, name)
+			m, ok := loaded[name]
+			if !ok {
+				r, err := open(name)
+				if err != nil {
+					return err
+				}
+				img, err := png.Decode(r)
+				r.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				m = img.In
+				loaded[name] = m
+			}
+			if prep := effect.Preparation(key, linear); prep != "" {
+				id := name + "\x00" + prep
+				prepared, ok := loaded[id]
+				if !ok {
+					prepared = effect.PrepareImage(key, m, linear)
+					loaded[id] = prepared
+				}
+				m = prepared
+			}
+			if effects[i].Images == nil {
+				effects[i].Images = make(map[string]png.Buffer)
+			}
+			effects[i].Images[key] = m
+		}
+	}
+	return nil
+}
+
+// roundTrip decodes a parsed value into v through its JSON form, so YAML and TOML
+// jobs share the JSON field names and EffectSpec's decoding. Unknown fields are
+// errors, which catches misspelled keys.
+func roundTrip(value interface{}, v interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// expandPresets replaces parameterless effects that name a preset with its effects.
+func expandPresets(effects []png.EffectSpec, presets map[string][]png.EffectSpec, using []string) ([]png.EffectSpec, error) {
+	var out []png.EffectSpec
+	for _, effect := range effects {
+		preset, ok := presets[effect.Name]
+		if !ok || effect.Params != nil {
+			out = append(out, effect)
+			continue
+		}
+		for _, name := range using {
+			if name == effect.Name {
+				return nil, fmt.Errorf("preset %q refers to itself", effect.Name)
+			}
+		}
+		expanded, err := expandPresets(preset, presets, append(using, effect.Name))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// validate checks a task's inputs, output and effects.
+func (task *ImageTask) validate() error {
+	inputs := 0
+	for _, in := range []string{task.InPath, task.InGlob, task.InDir} {
+		if in != "" {
+			inputs++
+		}
+	}
+	if inputs != 1 {
+		return fmt.Errorf("needs exactly one of inPath, inGlob and inDir")
+	}
+	if task.Graph != nil {
+		if len(task.Effects) > 0 {
+			return fmt.Errorf("has a graph, so its effects go in the graph's nodes")
+		}
+		if task.Graph.Output == "" && len(task.Outputs) == 0 {
+			return fmt.Errorf("graph needs an output node")
+		}
+		if err := task.Graph.validate(); err != nil {
+			return err
+		}
+	}
+	if len(task.Outputs) > 0 {
+		if task.OutPath != "" {
+			return fmt.Errorf("has both an outPath and outputs")
+		}
+		if !reflect.DeepEqual(task.SaveOptions, png.SaveOptions{}) {
+			return fmt.Errorf("has outputs, which take their encoder settings one by one")
+		}
+		names := make(map[string]bool)
+		for _, out := range task.Outputs {
+			if out.Name == "" {
+				return fmt.Errorf("every output needs a name")
+			}
+			if names[out.Name] {
+				return fmt.Errorf("has two outputs named %q", out.Name)
+			}
+			names[out.Name] = true
+			if out.Node == "" {
+				continue
+			}
+			if task.Graph == nil {
+				return fmt.Errorf("output %q starts from node %q, but the task has no graph", out.Name, out.Node)
+			}
+			if _, ok := task.Graph.Nodes[out.Node]; out.Node != inputNode && !ok {
+				return fmt.Errorf("output %q starts from node %q, which doesn't exist", out.Name, out.Node)
+			}
+		}
+	}
+	for _, out := range task.outputs() {
+		if err := out.validateOutput(); err != nil {
+			if out.output != "" {
+				return fmt.Errorf("output %q: %v", out.output, err)
+			}
+			return err
+		}
+	}
+	switch task.Buffer {
+	case "", "float32":
+	case "rgba64":
+		if task.Linear {
+			return fmt.Errorf("linear light needs float32 buffers")
+		}
+	default:
+		return fmt.Errorf("unknown buffer %q", task.Buffer)
+	}
+	return nil
+}
+
+// validateOutput checks the output name, effects and encoder settings of a task
+// with a single output.
+func (task *ImageTask) validateOutput() error {
+	if task.InPath != "" && task.OutPath == "" && task.OutTemplate == "" {
+		return fmt.Errorf("needs an outPath or outTemplate")
+	}
+	// Outputs stay under the sink's root, whatever the size and input turn out to be
+	probe := *task
+	probe.Size = "size"
+	if probe.InPath == "" {
+		probe.InPath = "in.png"
+	}
+	for _, name := range []string{task.OutPath, outputName(&probe)} {
+		if outside(name) {
+			return fmt.Errorf("output name %q is outside the output directory", name)
+		}
+	}
+	for _, effect := range task.Effects {
+		if err := effect.Validate(); err != nil {
+			return err
+		}
+		if refs := nodeRefs(effect); len(refs) > 0 {
+			return fmt.Errorf("effect %q refers to node %q outside a graph node", effect.Name, refs[0])
+		}
+	}
+	// The extension of a templated name is only known once the input is
+	name := task.OutPath
+	if task.OutTemplate != "" {
+		name = task.OutTemplate
+	}
+	if task.InPath == "" && task.OutTemplate == "" || strings.Contains(name, "{ext}") || strings.Contains(name, "{name}") {
+		name = ""
+	}
+	return task.SaveOptions.Validate(name)
+}
+
+// outside reports whether a slash separated path is absolute or climbs out of the
+// directory it is relative to.
+func outside(name string) bool {
+	name = path.Clean(name)
+	return path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../")
+}
+
+// parseJob splits a job file into its includes, presets and tasks.
+func parseJob(name string, data []byte) (*jobDoc, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return parseYAML(name, data)
+	case ".toml":
+		return parseTOML(name, data)
+	}
+	return parseJSON(name, data)
+}
+
+// skip returns the offset of the first byte at or after offset that is neither
+// space nor a JSON separator.
+func skip(data []byte, offset int) int {
+	for offset < len(data) && strings.ContainsRune(" \t\r\n,:", rune(data[offset])) {
+		offset++
+	}
+	return offset
+}
+
+// lineAt returns the line of the first byte at or after offset that is neither
+// space nor a JSON separator.
+func lineAt(data []byte, offset int) int {
+	return 1 + bytes.Count(data[:skip(data, offset)], []byte("\n"))
+}
+
+// walk calls member with the offset of every member of the JSON array or object
+// at offset start of data, and its key for an object.
+func walk(data []byte, start int, member func(key string, at int)) {
+	dec := json.NewDecoder(bytes.NewReader(data[start:]))
+	open, err := dec.Token()
+	if delim, ok := open.(json.Delim); err != nil || !ok || delim != '[' && delim != '{' {
+		return
+	}
+	for dec.More() {
+		var key string
+		if open == json.Delim('{') {
+			token, err := dec.Token()
+			if err != nil {
+				return
+			}
+			key, _ = token.(string)
+		}
+		at := skip(data, start+int(dec.InputOffset()))
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return
+		}
+		member(key, at)
+	}
+}
+
+func parseJSON(name string, data []byte) (*jobDoc, error) {
+	doc := &jobDoc{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		start := int(dec.InputOffset())
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			if err == io.EOF {
+				break
+			}
+			offset := start
+			if syntax, ok := err.(*json.SyntaxError); ok {
+				offset = int(syntax.Offset)
+			}
+			return nil, fmt.Errorf("%s:%d: %v", name, lineAt(data, offset), err)
+		}
+		line := lineAt(data, start)
+		fields, isObject := value.(map[string]interface{})
+		_, hasTasks := fields["tasks"]
+		_, hasPresets := fields["presets"]
+		_, hasInclude := fields["include"]
+		if isObject && (hasTasks || hasPresets || hasInclude) {
+			// A job document. Walk it again for the lines of its tasks and presets,
+			// which decoding doesn't keep.
+			var tasks []int
+			presets := make(map[string]int)
+			walk(data, skip(data, start), func(key string, at int) {
+				switch key {
+				case "tasks":
+					walk(data, at, func(_ string, at int) { tasks = append(tasks, lineAt(data, at)) })
+				case "presets":
+					walk(data, at, func(preset string, at int) { presets[preset] = lineAt(data, at) })
+				}
+			})
+			lineOf := func(key string, index int) int {
+				if index >= 0 && index < len(tasks) {
+					return tasks[index]
+				}
+				if l, ok := presets[key]; ok && index < 0 {
+					return l
+				}
+				return line
+			}
+			if err := doc.fill(name, fields, lineOf); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		doc.tasks = append(doc.tasks, jobEntry{name, line, value})
+	}
+	return doc, nil
+}
+
+// fill reads the keys of a job document. lineOf returns the line of the index-th
+// task, or of the preset called key.
+func (doc *jobDoc) fill(name string, fields map[string]interface{}, lineOf func(key string, index int) int) error {
+	for key, value := range fields {
+		switch key {
+		case "include":
+			if err := roundTrip(value, &doc.include); err != nil {
+				return fmt.Errorf("%s: include: %v", name, err)
+			}
+		case "presets":
+			var presets map[string]interface{}
+			if err := roundTrip(value, &presets); err != nil {
+				return fmt.Errorf("%s: presets must map names to effect lists", name)
+			}
+			doc.presets = make(map[string]jobEntry)
+			for presetName, effects := range presets {
+				doc.presets[presetName] = jobEntry{name, lineOf(presetName, -1), effects}
+			}
+		case "tasks":
+			var tasks []interface{}
+			if err := roundTrip(value, &tasks); err != nil {
+				return fmt.Errorf("%s: tasks must be a list", name)
+			}
+			for i, task := range tasks {
+				doc.tasks = append(doc.tasks, jobEntry{name, lineOf("", i), task})
+			}
+		default:
+			return fmt.Errorf("%s: unknown key %q", name, key)
+		}
+	}
+	return nil
+}
+
+func parseYAML(name string, data []byte) (*jobDoc, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	doc := &jobDoc{}
+	if len(root.Content) == 0 {
+		return doc, nil
+	}
+	top := root.Content[0]
+	var fields map[string]interface{}
+	if err := top.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", name, top.Line, err)
+	}
+	// Find the nodes of the presets and tasks for their lines
+	lines := make(map[string]int)
+	var taskLines []int
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		key, value := top.Content[i], top.Content[i+1]
+		switch key.Value {
+		case "presets":
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				lines[value.Content[j].Value] = value.Content[j].Line
+			}
+		case "tasks":
+			for _, task := range value.Content {
+				taskLines = append(taskLines, task.Line)
+			}
+		}
+	}
+	err := doc.fill(name, fields, func(key string, index int) int {
+		if index >= 0 && index < len(taskLines) {
+			return taskLines[index]
+		}
+		return lines[key]
+	})
+	return doc, err
+}
+
+func parseTOML(name string, data []byte) (*jobDoc, error) {
+	var fields map[string]interface{}
+	if _, err := toml.Decode(string(data), &fields); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	// The decoder keeps no positions, so find the [[tasks]] headers and preset keys in the text
+	lines := make(map[string]int)
+	var taskLines []int
+	section := ""
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimSpace(text)
+		switch {
+		case text == "[[tasks]]":
+			taskLines = append(taskLines, i+1)
+			section = "tasks"
+		case strings.HasPrefix(text, "["):
+			section = strings.Trim(text, "[] ")
+		case section == "presets" && strings.Contains(text, "="):
+			lines[strings.Trim(strings.TrimSpace(strings.SplitN(text, "=", 2)[0]), `"`)] = i + 1
+		}
+	}
+	doc := &jobDoc{}
+	err := doc.fill(name, fields, func(key string, index int) int {
+		if index >= 0 && index < len(taskLines) {
+			return taskLines[index]
+		}
+		return lines[key]
+	})
+	return doc, err
+}
@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"bytes"
+	"image"
+	stdpng "image/png"
+	"io"
+	"proj3/png"
+	"strings"
+	"testing"
+)
+
+func TestJSONJobDocumentLines(t *testing.T) {
+	job := `{
+  "presets": {
+    "soft": ["B"],
+    "B": ["S"]
+  },
+  "tasks": [
+    {"inPath": "a.png", "outPath": "a_out.png", "effects": ["soft"]},
+    {"inPath": "b.png", "outPath": "b_out.png", "effects": ["G"]},
+
+    {"outPath": "c_out.png", "effects": ["G"]}
+  ]
+}
+`
+	_, err := LoadTasks(MemorySource{Effects: []byte(job)})
+	if err == nil {
+		t.Fatal("the job loaded without errors")
+	}
+	for _, want := range []string{`effects.txt:4: preset "B"`, "effects.txt:10: task 3:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("errors %q don't mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadImagesScalesOnce(t *testing.T) {
+	var file bytes.Buffer
+	stdpng.Encode(&file, image.NewGray(image.Rect(0, 0, 8, 8)))
+	opens := 0
+	open := func(name string) (io.ReadCloser, error) {
+		opens++
+		return io.NopCloser(bytes.NewReader(file.Bytes())), nil
+	}
+	blend := func(scale float64) png.EffectSpec {
+		return png.EffectSpec{Name: "blend", Params: map[string]interface{}{"image": "overlay.png", "scale": scale}}
+	}
+	effects := []png.EffectSpec{blend(0.5), blend(1), blend(0.5)}
+	loaded := make(map[string]png.Buffer)
+	if err := loadImages(&ImageTask{}, effects[:2], "job.txt", open, loaded); err != nil {
+		t.Fatal(err)
+	}
+	// Another task's effects, loaded into the same job
+	if err := loadImages(&ImageTask{}, effects[2:], "job.txt", open, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if opens != 1 {
+		t.Errorf("overlay.png was opened %d times, want once", opens)
+	}
+	half, full := effects[0].Images["image"], effects[1].Images["image"]
+	if got := half.Bounds(); got != image.Rect(0, 0, 4, 4) {
+		t.Errorf("the overlay at scale 0.5 has bounds %v, want %v", got, image.Rect(0, 0, 4, 4))
+	}
+	if got := full.Bounds(); got != image.Rect(0, 0, 8, 8) {
+		t.Errorf("the overlay at scale 1 has bounds %v, want %v", got, image.Rect(0, 0, 8, 8))
+	}
+	if effects[2].Images["image"] != half {
+		t.Error("two effects with the same scale got separately scaled overlays")
+	}
+}
+
+func TestOutputNameOutsideRoot(t *testing.T) {
+	for _, test := range []struct {
+		task string
+		ok   bool
+	}{
+		{`{"inPath": "a.png", "outPath": "out/a.png"}`, true},
+		{`{"inPath": "a.png", "outPath": "b/../a.png"}`, true},
+		{`{"inPath": "a.png", "outPath": "../a.png"}`, false},
+		{`{"inPath": "a.png", "outPath": "b/../../a.png"}`, false},
+		{`{"inPath": "a.png", "outPath": "/tmp/a.png"}`, false},
+		{`{"inPath": "a.png", "outTemplate": "{size}/../{stem}.jpg"}`, true},
+		{`{"inPath": "a.png", "outTemplate": "/tmp/{stem}.jpg"}`, false},
+		{`{"inPath": "a.png", "outTemplate": "../{stem}.jpg"}`, false},
+		{`{"inPath": "a.png", "outTemplate": "{size}/../../{name}"}`, false},
+		{`{"inGlob": "*.png", "outTemplate": "x/../../{name}"}`, false},
+		{`{"inPath": "a.png", "outPath": "/tmp/a.png", "outTemplate": "{stem}.png"}`, false},
+	} {
+		_, err := LoadTasks(MemorySource{Effects: []byte(test.task + "\n")})
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.task, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "outside the output directory")) {
+			t.Errorf("%s: error %v, want one about the output directory", test.task, err)
+		}
+	}
+}
+
+func TestRuntimeFieldsNotInJobs(t *testing.T) {
+	for _, field := range []string{`"Size": "large"`, `"Image": {}`, `"ChunkStart": 3`, `"Top": true`, `"Bottom": true`, `"ChunkEnd": 9`} {
+		job := `{"inPath": "a.png", "outPath": "b.png", ` + field + "}\n"
+		if _, err := LoadTasks(MemorySource{Effects: []byte(job)}); err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("%s: error %v, want an unknown field", field, err)
+		}
+	}
+}
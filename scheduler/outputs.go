@@ -0,0 +1,287 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"proj3/png"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Output is one of several results of a task. The task's input is decoded once,
+// its effects run, and every output continues from there with effects of its own
+// before it is saved under its own name with its own encoder settings. Outputs
+// whose effects start alike share the work on the common part as well.
+type Output struct {
+	Name        string           `json:"name"`        // fills {output} in output templates
+	OutPath     string           `json:"outPath"`     // as ImageTask.OutPath
+	OutTemplate string           `json:"outTemplate"` // as ImageTask.OutTemplate, the task's if empty
+	Node        string           `json:"node"`        // the graph node the effects start from, the graph's output if empty
+	Effects     []png.EffectSpec `json:"effects"`     // run after the task's effects
+
+	png.SaveOptions // output format, depth and encoder settings
+}
+
+// outputs returns a task per output of a task that has them, or the task itself.
+func (task *ImageTask) outputs() []*ImageTask {
+	if len(task.Outputs) == 0 {
+		if task.Graph != nil {
+			task.node = task.Graph.Output
+		}
+		return []*ImageTask{task}
+	}
+	tasks := make([]*ImageTask, len(task.Outputs))
+	for i, out := range task.Outputs {
+		t := *task
+		t.Outputs = nil
+		t.output = out.Name
+		t.node = out.Node
+		if t.node == "" && task.Graph != nil {
+			t.node = task.Graph.Output
+		}
+		t.OutPath = out.OutPath
+		if out.OutTemplate != "" {
+			t.OutTemplate = out.OutTemplate
+		}
+		t.Effects = append(append([]png.EffectSpec(nil), task.Effects...), out.Effects...)
+		t.SaveOptions = out.SaveOptions
+		tasks[i] = &t
+	}
+	return tasks
+}
+
+// split returns the tasks a loaded task runs as: one per output that is due and
+// frame of an animated input.
+func (task *ImageTask) split() []*ImageTask {
+	if len(task.Outputs) == 0 && task.Graph == nil {
+		return task.frames()
+	}
+	images := []*png.Image{task.Image}
+	if task.animation != nil {
+		images = images[:0]
+		for _, frame := range task.animation.Frames {
+			images = append(images, frame.Image)
+		}
+	}
+	// Outputs that start from the same graph node share a tree of stages
+	var starts []string
+	members := make(map[string][]int)
+	for k, out := range task.due {
+		if members[out.node] == nil {
+			starts = append(starts, out.node)
+		}
+		members[out.node] = append(members[out.node], k)
+	}
+	// leaves[i][k] is the stage output k picks up from on frame i
+	leaves := make([][]*stage, len(images))
+	for i, img := range images {
+		roots := map[string]*stage{"": {image: img}}
+		if task.Graph != nil {
+			roots = task.Graph.stages(img, starts)
+		}
+		leaves[i] = make([]*stage, len(task.due))
+		for _, start := range starts {
+			chains := make([][]png.EffectSpec, len(members[start]))
+			for j, k := range members[start] {
+				chains[j] = task.due[k].Effects
+			}
+			for j, leaf := range newStages(roots[start], chains) {
+				leaves[i][members[start][j]] = leaf
+			}
+		}
+	}
+	var tasks []*ImageTask
+	for k, out := range task.due {
+		if task.animation == nil {
+			t := *out
+			t.Image = shareInput(images[0])
+			t.stage = leaves[0][k]
+			tasks = append(tasks, &t)
+			continue
+		}
+		// Every output saves an animation of its own
+		anim := &animation{
+			Animation: &png.Animation{Frames: make([]png.Frame, len(images)), Loops: task.animation.Loops, Format: task.animation.Format},
+			remaining: int32(len(images)),
+		}
+		for i, frame := range task.animation.Frames {
+			frame.Image = shareInput(frame.Image)
+			anim.Frames[i] = frame
+			t := *out
+			t.Image = frame.Image
+			t.animation = anim
+			t.stage = leaves[i][k]
+			tasks = append(tasks, &t)
+		}
+	}
+	return tasks
+}
+
+// shareInput returns a copy of a decoded image for an output, with the pixels
+// left for its stage to fill in.
+func shareInput(img *png.Image) *png.Image {
+	c := *img
+	c.In, c.Out = nil, nil
+	return &c
+}
+
+// stage is a run of effects several outputs of a task have in common, or a node
+// of its graph. The first output to reach it runs it, on the result of its parent,
+// and the others wait for and share that result, which nothing writes to.
+type stage struct {
+	parent  *stage
+	refs    map[string]*stage // the graph nodes the effects take as images, by name
+	effects []png.EffectSpec
+	depth   int        // how many effects of an output's chain the result has had applied
+	image   *png.Image // the decoded input
+	users   int32      // stages and outputs that have yet to read the result
+	once    sync.Once
+	result  png.Buffer
+	owned   bool // the result is a buffer of the stage's own rather than its input
+}
+
+// output returns the result of the stage, running it if no output has yet. The
+// stages it depends on run concurrently unless the scheduler is sequential.
+func (s *stage) output(premultiplied bool, config Config) png.Buffer {
+	s.once.Do(func() {
+		if s.parent == nil {
+			s.result = s.image.In
+			return
+		}
+		results := make(map[string]png.Buffer)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, ref := range s.refs {
+			run := func(name string, ref *stage) {
+				result := ref.output(premultiplied, config)
+				mu.Lock()
+				results[name] = result
+				mu.Unlock()
+			}
+			if config.Mode == "s" {
+				run(name, ref)
+				continue
+			}
+			wg.Add(1)
+			go func(name string, ref *stage) {
+				defer wg.Done()
+				run(name, ref)
+			}(name, ref)
+		}
+		in := s.parent.output(premultiplied, config)
+		wg.Wait()
+
+		effects := s.effects
+		if len(results) > 0 {
+			effects = make([]png.EffectSpec, len(s.effects))
+			for i, effect := range s.effects {
+				images := make(map[string]png.Buffer)
+				for key, m := range effect.Images {
+					images[key] = m
+				}
+				for _, key := range effect.ImageFiles() {
+					if name := effect.String(key, ""); strings.HasPrefix(name, "@") {
+						// Node results are already in the task's light
+						images[key] = effect.PrepareImage(key, results[name[1:]], false)
+					}
+				}
+				effect.Images = images
+				effects[i] = effect
+			}
+		}
+		img := shareInput(s.image)
+		img.In, img.Out, img.Bounds = in, png.NewBuffer(in, in.Bounds()), in.Bounds()
+		runEffects(&ImageTask{Effects: effects, Image: img, Premultiplied: premultiplied}, config)
+		s.result, s.owned = img.Out, img.Out != in
+
+		// A result that is the input holds on to the parent until it is released
+		if s.owned {
+			s.parent.release()
+		}
+		for _, ref := range s.refs {
+			ref.release()
+		}
+	})
+	return s.result
+}
+
+// release notes that one user is done with the stage's result. The last one gives
+// it back to the buffer pools, so intermediate images are reused as soon as
+// nothing needs them.
+func (s *stage) release() {
+	if atomic.AddInt32(&s.users, -1) == 0 {
+		if s.owned {
+			png.PutBuffer(s.result)
+		} else if s.parent != nil {
+			s.parent.release()
+		}
+		s.result = nil
+	}
+}
+
+// newStages builds the tree of stages that runs chains of effects on the result of
+// root with every common prefix run once, and returns the stage each chain leaves
+// off at. The rest of a chain is its own.
+func newStages(root *stage, chains [][]png.EffectSpec) []*stage {
+	keys := make([][]string, len(chains))
+	for k, chain := range chains {
+		for _, effect := range chain {
+			key, err := json.Marshal(effect)
+			if err != nil {
+				panic(err)
+			}
+			keys[k] = append(keys[k], string(key))
+		}
+	}
+	leaves := make([]*stage, len(chains))
+	leave := func(k int, s *stage) {
+		leaves[k] = s
+		s.users++
+	}
+	var branch func(parent *stage, members []int)
+	branch = func(parent *stage, members []int) {
+		// Group the chains by their next effect, in order of appearance
+		groups := make(map[string][]int)
+		var order []string
+		for _, k := range members {
+			if len(keys[k]) == parent.depth {
+				leave(k, parent)
+				continue
+			}
+			key := keys[k][parent.depth]
+			if groups[key] == nil {
+				order = append(order, key)
+			}
+			groups[key] = append(groups[key], k)
+		}
+		for _, key := range order {
+			group := groups[key]
+			if len(group) == 1 {
+				leave(group[0], parent)
+				continue
+			}
+			end := parent.depth + 1
+			for shared(keys, group, end) {
+				end++
+			}
+			parent.users++
+			branch(&stage{parent: parent, effects: chains[group[0]][parent.depth:end], depth: end, image: root.image}, group)
+		}
+	}
+	all := make([]int, len(chains))
+	for k := range all {
+		all[k] = k
+	}
+	branch(root, all)
+	return leaves
+}
+
+// shared reports whether every chain of group has the same effect at index i.
+func shared(keys [][]string, group []int, i int) bool {
+	for _, k := range group {
+		if len(keys[k]) <= i || keys[k][i] != keys[group[0]][i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,50 +1,48 @@
 package scheduler
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"os"
-	myPng "proj3/png"
 	"runtime"
 	"strings"
 )
 
 func RunPipeline(config Config) {
-	dirPath := "../data/in/"
+	config = config.withCache()
 	runtime.GOMAXPROCS(config.ThreadCount)
+	inc := newIncremental(config)
 	generator := func(done <-chan interface{}, config Config) <-chan *ImageTask {
 		sizesString := config.DataDirs
 		sizes := strings.Split(sizesString, "+")
 		taskStream := make(chan *ImageTask)
-		effectsPathFile := fmt.Sprintf("../data/effects.txt")
-		effectsFile, _ := os.Open(effectsPathFile)
-		reader := json.NewDecoder(effectsFile)
+		source := config.source()
+		imageTasks := getTasks(config)
 		// we spawn goroutines for images of all sizes
 
 		go func() {
 			defer close(taskStream)
-			for {
-				var imageTask *ImageTask
-				if err := reader.Decode(&imageTask); err != nil {
-					if err == io.EOF {
-						break
-					}
-					log.Fatalf("error decoding JSON: %v", err)
-				}
+			for _, imageTask := range imageTasks {
 				for _, size := range sizes {
-					imageTask.Size = size
-					location := dirPath + imageTask.Size + "/" + imageTask.InPath
-					img, err := myPng.Load(location)
-					imageTask.Image = img
+					// every size gets its own copy, the earlier ones are still in flight
+					sized := *imageTask
+					sized.Size = size
+					expanded, err := sized.expand(source)
 					if err != nil {
 						panic(err)
 					}
-					select {
-					case <-done:
-						return
-					case taskStream <- imageTask:
+					for _, task := range expanded {
+						loaded, err := task.load(source, inc)
+						if err != nil {
+							panic(err)
+						}
+						if !loaded {
+							continue
+						}
+						for _, frame := range task.split() {
+							select {
+							case <-done:
+								return
+							case taskStream <- frame:
+							}
+						}
 					}
 				}
 			}
@@ -64,7 +62,7 @@ func RunPipeline(config Config) {
 				select {
 				case <-done:
 					return
-				case imageStream <- ApplyEffects(i, false, 0, 0):
+				case imageStream <- runEffects(i, config):
 				}
 			}
 		}()
@@ -77,13 +75,12 @@ func RunPipeline(config Config) {
 		completed := make(chan bool)
 		go func() {
 			defer close(completed)
+			sink := config.sink()
 			for task := range imageStream {
-				task.OutPath = task.Size + "_" + task.OutPath
-				outPath := "../data/out/" + task.OutPath
 				select {
 				case <-done:
 					return
-				case completed <- task.Image.Save(outPath):
+				case completed <- task.save(sink, inc):
 				}
 			}
 		}()
@@ -96,4 +93,5 @@ func RunPipeline(config Config) {
 	for _ = range pipeline {
 		continue
 	}
+	inc.flush()
 }
@@ -1,16 +1,12 @@
 package scheduler
 
 import (
-	"encoding/json"
-	"io"
-	"log"
-	"os"
-	"proj3/png"
 	"strings"
 	"sync"
 )
 
 func RunDeque(config Config) {
+	config = config.withCache()
 	numThreads := config.ThreadCount
 	//sends a stream of chunked image tasks
 	//receives a stream of chunked image tasks
@@ -22,35 +18,37 @@ func RunDeque(config Config) {
 		wps = append(wps, NewQueue())
 	}
 
-	dirPath := "../data/in/"
 	sizesString := config.DataDirs
 	sizes := strings.Split(sizesString, "+")
 	MainImageTasks := make(chan *ImageTask)
-	effectsPathFile := "../data/effects.txt"
-	effectsFile, _ := os.Open(effectsPathFile)
-	reader := json.NewDecoder(effectsFile)
+	source := config.source()
+	inc := newIncremental(config)
+	mainTasks := getTasks(config)
 	//Generator stage, add tasks to the MainImageTasks channel
 	go func() {
 		defer close(MainImageTasks)
-		for {
-			var MainTask *ImageTask
-			if err := reader.Decode(&MainTask); err != nil {
-				if err == io.EOF {
-					break // End of file reached
-				}
-				log.Fatalf("error decoding JSON: %v", err)
-			}
+		for _, MainTask := range mainTasks {
 			for _, size := range sizes {
 
-				MainTask.Size = size
-
-				location := dirPath + "/" + MainTask.Size + "/" + MainTask.InPath
-				pngImage, err := png.Load(location)
+				// every size gets its own copy, the work pools hold on to them
+				sized := *MainTask
+				sized.Size = size
+				expanded, err := sized.expand(source)
 				if err != nil {
 					panic(err)
 				}
-				MainTask.Image = pngImage
-				MainImageTasks <- MainTask
+				for _, task := range expanded {
+					loaded, err := task.load(source, inc)
+					if err != nil {
+						panic(err)
+					}
+					if !loaded {
+						continue
+					}
+					for _, frame := range task.split() {
+						MainImageTasks <- frame
+					}
+				}
 
 			}
 		}
@@ -68,7 +66,7 @@ func RunDeque(config Config) {
 	for i := 0; i < numThreads; i++ {
 		wg.Add(1)
 		go func(taskOut []*ImageTask) {
-			localPool := Worker(i, wps, &wg)
+			localPool := Worker(i, wps, &wg, config)
 			allTasks = append(allTasks, localPool)
 		}(taskOut)
 		wg.Wait()
@@ -77,15 +75,15 @@ func RunDeque(config Config) {
 		taskOut = append(taskOut, tasks...)
 
 	}
+	sink := config.sink()
 	for _, task := range taskOut {
-		task.OutPath = task.Size + "_" + task.OutPath
-		outPath := "../data/out/" + task.OutPath
-		_ = task.Image.Save(outPath)
+		_ = task.save(sink, inc)
 	}
+	inc.flush()
 
 }
 
-func Worker(id int, wps []WorkPool, wg *sync.WaitGroup) []*ImageTask {
+func Worker(id int, wps []WorkPool, wg *sync.WaitGroup, config Config) []*ImageTask {
 	var localPool []*ImageTask
 	wp := wps[id] //identify our work pool
 	for {
@@ -98,7 +96,7 @@ func Worker(id int, wps []WorkPool, wg *sync.WaitGroup) []*ImageTask {
 			}
 			task = wp.PopBottom() // Retrieve the stolen task
 		}
-		task = ApplyEffects(task, false, 0, 0)
+		task = runEffects(task, config)
 		localPool = append(localPool, task)
 	}
 }
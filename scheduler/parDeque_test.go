@@ -0,0 +1,40 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"proj3/png"
+	"strings"
+	"testing"
+)
+
+// BenchmarkDeque runs a job of sixteen 512x512 images through the work-stealing
+// scheduler on four threads in four chunks each, reporting allocations and pool
+// misses per run.
+func BenchmarkDeque(b *testing.B) {
+	m := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	for y := 0; y < 512; y++ {
+		for x := 0; x < 512; x++ {
+			m.Set(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var encoded bytes.Buffer
+	stdpng.Encode(&encoded, m)
+	var job strings.Builder
+	images := make(map[string][]byte)
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&job, `{"inPath": "%d.png", "outPath": "%d.png", "effects": ["S", "E", "B"]}`+"\n", i, i)
+		images[fmt.Sprintf("small/%d.png", i)] = encoded.Bytes()
+	}
+	source := MemorySource{Effects: []byte(job.String()), Images: images}
+
+	b.ReportAllocs()
+	misses := png.BufferStats().Misses
+	for i := 0; i < b.N; i++ {
+		Schedule(Config{DataDirs: "small", Mode: "parDeque", ThreadCount: 4, Chunks: 4, Source: source, Sink: &MemorySink{}})
+	}
+	b.ReportMetric(float64(png.BufferStats().Misses-misses)/float64(b.N), "misses/op")
+}
@@ -1,9 +1,35 @@
 package scheduler
 
+import (
+	"log"
+	"proj3/png"
+)
+
 type Config struct {
 	DataDirs    string //Represents the data directories to use to load the images.
 	Mode        string // Represents which scheduler scheme to use
 	ThreadCount int    // Runs parallel version with the specified number of threads
+	Chunks      int    // Splits each image into this many horizontal chunks processed concurrently (0 or 1 disables)
+	Source      Source // Where the effects list and input images come from, the data directory if nil
+	Sink        Sink   // Where output images go, the data directory if nil
+	Incremental string // "mtime" or "hash" skips tasks whose output is up to date, "" processes everything
+	Manifest    string // Where "hash" mode records what each output was made from, ../data/out/.manifest.json if empty
+	CacheDir    string // Directory of the effect result cache, no caching if empty
+	CacheSize   int64  // Evicts least recently used cache entries above this many bytes, 0 for no limit
+
+	cache *png.Cache // opened from CacheDir at the start of a run
+}
+
+// withCache opens the result cache the configuration names, once per run.
+func (config Config) withCache() Config {
+	if config.CacheDir != "" && config.cache == nil {
+		cache, err := png.NewCache(config.CacheDir, config.CacheSize)
+		if err != nil {
+			log.Fatalf("error opening cache: %v", err)
+		}
+		config.cache = cache
+	}
+	return config
 }
 
 // Run the correct version based on the Mode field of the configuration value
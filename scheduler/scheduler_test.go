@@ -0,0 +1,138 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	stdpng "image/png"
+	"io"
+	"proj3/png"
+	"sync"
+	"testing"
+)
+
+// modesJob exercises every kind of effect: kernels, fused point operations, masks,
+// color spaces, global statistics, transforms, and outputs that share a prefix.
+const modesJob = `{"inPath": "a.png", "outPath": "a.png", "effects": ["S", {"name": "brightness", "amount": 0.1}, {"name": "hue", "degrees": 40}, {"name": "B", "mask": {"x": 5, "y": 7, "width": 30, "height": 20}}]}
+{"inPath": "b.png", "outPath": "b.png", "effects": [{"name": "U", "radius": 3, "amount": 0.8}, "equalize", {"name": "rotate", "angle": 90}, {"name": "E", "space": "lab", "channels": "L"}]}
+{"inPath": "a.png", "outPath": "c.png", "buffer": "rgba64", "effects": [{"name": "clahe", "tileSize": 16}, {"name": "resize", "width": 40}, "G", {"name": "levels", "auto": true, "mask": {"points": [[0, 0], [40, 3], [10, 30]]}}]}
+{"inPath": "b.png", "outputs": [{"name": "x", "outPath": "x.png", "effects": ["B", "E"]}, {"name": "y", "outPath": "y.png", "effects": ["B", "S"]}, {"name": "z", "outPath": "z.png"}], "effects": ["S", {"name": "contrast", "amount": 1.3}]}
+`
+
+// modesImages returns two differently patterned inputs.
+func modesImages() map[string][]byte {
+	images := make(map[string][]byte)
+	for name, seed := range map[string]int{"a.png": 1, "b.png": 7} {
+		m := image.NewNRGBA(image.Rect(0, 0, 61, 45))
+		for y := 0; y < 45; y++ {
+			for x := 0; x < 61; x++ {
+				m.Set(x, y, color.NRGBA{uint8(x*seed*37 + y*11), uint8(y * 5 * seed), uint8((x ^ y) * 9), uint8(255 - (x+y)%3*40)})
+			}
+		}
+		var buf bytes.Buffer
+		stdpng.Encode(&buf, m)
+		images["small/"+name] = buf.Bytes()
+	}
+	return images
+}
+
+// TestModesAgree runs the same job through every scheduler, with and without
+// chunks and the result cache, which must all write the same bytes.
+func TestModesAgree(t *testing.T) {
+	source := MemorySource{Effects: []byte(modesJob), Images: modesImages()}
+	run := func(mode string, chunks int, cacheDir string) map[string][]byte {
+		sink := &MemorySink{}
+		Schedule(Config{DataDirs: "small", Mode: mode, ThreadCount: 3, Chunks: chunks, CacheDir: cacheDir, Source: source, Sink: sink})
+		return sink.Outputs
+	}
+	want := run("s", 0, "")
+	if len(want) != 6 {
+		t.Fatalf("the job wrote %d outputs, want 6", len(want))
+	}
+	for _, mode := range []string{"s", "parPipeline", "parDeque"} {
+		for _, chunks := range []int{0, 3} {
+			cacheDir := t.TempDir()
+			// The second cached run reads every result from the first
+			for i, dir := range []string{"", cacheDir, cacheDir} {
+				got := run(mode, chunks, dir)
+				for name, data := range want {
+					if !bytes.Equal(got[name], data) {
+						t.Errorf("%s, %d chunks, cache run %d: %s differs from a sequential run", mode, chunks, i, name)
+					}
+				}
+			}
+		}
+	}
+}
+
+// countingSource counts how often each input is opened.
+type countingSource struct {
+	MemorySource
+	mu    sync.Mutex
+	opens map[string]int
+}
+
+func (src *countingSource) Open(task *ImageTask) (io.ReadCloser, error) {
+	src.mu.Lock()
+	src.opens[task.InPath]++
+	src.mu.Unlock()
+	return src.MemorySource.Open(task)
+}
+
+// TestSharedWorkRunsOnce checks that a task's input is read and decoded once for
+// all its outputs, and that the stages of the outputs run every common prefix of
+// their effects once.
+func TestSharedWorkRunsOnce(t *testing.T) {
+	for _, mode := range []string{"s", "parPipeline", "parDeque"} {
+		src := &countingSource{MemorySource: MemorySource{Effects: []byte(modesJob), Images: modesImages()}, opens: make(map[string]int)}
+		Schedule(Config{DataDirs: "small", Mode: mode, ThreadCount: 3, Source: src, Sink: &MemorySink{}})
+		// a.png has two tasks, b.png two as well, one of them with three outputs
+		if src.opens["a.png"] != 2 || src.opens["b.png"] != 2 {
+			t.Errorf("%s: inputs opened %v, want twice each", mode, src.opens)
+		}
+	}
+
+	spec := func(name string) png.EffectSpec { return png.EffectSpec{Name: name} }
+	chains := [][]png.EffectSpec{
+		{spec("S"), spec("B"), spec("G")},
+		{spec("S"), spec("B"), spec("E")},
+		{spec("S"), spec("B")},
+		{spec("S"), spec("U")},
+		{spec("G")},
+		{},
+	}
+	// The distinct prefixes are S, SB, SBG, SBE, SU and G. Stages run the shared
+	// ones, and each output the rest of its chain after its stage.
+	const prefixes = 6
+	root := &stage{}
+	leaves := newStages(root, chains)
+	stages := make(map[*stage]bool)
+	runs := 0
+	for k, leaf := range leaves {
+		var chain []string
+		for s := leaf; s != root; s = s.parent {
+			stages[s] = true
+			chain = append(names(s.effects), chain...)
+		}
+		chain = append(chain, names(chains[k][leaf.depth:])...)
+		if got, want := fmt.Sprint(chain), fmt.Sprint(names(chains[k])); got != want {
+			t.Errorf("chain %d runs %s, want %s", k, got, want)
+		}
+		runs += len(chains[k]) - leaf.depth
+	}
+	for s := range stages {
+		runs += len(s.effects)
+	}
+	if runs != prefixes {
+		t.Errorf("the stages and outputs run %d effects, want %d", runs, prefixes)
+	}
+}
+
+func names(effects []png.EffectSpec) []string {
+	var out []string
+	for _, effect := range effects {
+		out = append(out, effect.Name)
+	}
+	return out
+}
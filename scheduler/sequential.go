@@ -1,153 +1,151 @@
 package scheduler
 
 import (
-	"encoding/json"
-	"fmt"
-	"image"
-	"image/draw"
-	"io"
 	"log"
-	"os"
 	"proj3/png"
-	myPng "proj3/png"
 	"strings"
 )
 
 func RunSequential(config Config) {
+	config = config.withCache()
 	// Example of initializing and using the Effects struct
 	sizesString := config.DataDirs
 	sizes := strings.Split(sizesString, "+")
+	inc := newIncremental(config)
+	images := getTasks(config)
 	for _, size := range sizes {
-		dirPath := "../data/in/"
-		images := getJSON(false)
-		for _, task := range images {
+		for _, image := range images {
+			task := *image
 			task.Size = size
-			task.processImage(dirPath)
+			expanded, err := task.expand(config.source())
+			if err != nil {
+				panic(err)
+			}
+			for _, task := range expanded {
+				task.processImage(config, inc)
+			}
 		}
 	}
+	inc.flush()
 
 }
 
 // struct to wrap the attributes of each image we wish to process as a task
 type ImageTask struct {
-	InPath     string     `json:"inPath"`
-	OutPath    string     `json:"outPath"`
-	Effects    []string   `json:"effects"`
-	Size       string     //get the size of image from CLI
-	Image      *png.Image //pointer to the image object for splitting
-	ChunkStart int        // starting y-coordinate of chunk
-	Top        bool       // indicates if the chunk is the top chunk
-	Bottom     bool       // indicates if the chunk is the bottom chunk
-	ChunkEnd   int        // ending y-coordinate of chunk
+	InPath        string           `json:"inPath"`
+	InGlob        string           `json:"inGlob"`      // process every input matching this pattern instead of InPath
+	InDir         string           `json:"inDir"`       // process every image under this directory instead of InPath
+	OutTemplate   string           `json:"outTemplate"` // output name template, see outputName
+	OutPath       string           `json:"outPath"`
+	Effects       []png.EffectSpec `json:"effects"`
+	Outputs       []Output         `json:"outputs"`       // several outputs instead of OutPath, see Output
+	Graph         *Graph           `json:"graph"`         // effects as a graph of nodes instead of a chain, see Graph
+	Premultiplied bool             `json:"premultiplied"` // filter alpha along with color, see png.Image.Premultiplied
+	Provenance    bool             `json:"provenance"`    // record the effect chain in a png text chunk of the output
+	AutoOrient    bool             `json:"autoOrient"`    // turn the input upright by its EXIF orientation before the effects
+	Linear        bool             `json:"linear"`        // run the effects in linear light, see png.Image.Linearize
+	Buffer        string           `json:"buffer"`        // "float32" (the default) keeps full precision between effects, "rgba64" rounds to 16 bits after each as before
+	hash          string           // hash of the input and effect chain in an incremental run
+	animation     *animation       // the animation an animated input's frame tasks share, see frames
+	output        string           // the name of the output the task saves, see Output
+	node          string           // the graph node the output's effects start from
+	due           []*ImageTask     // the outputs of a loaded task that aren't up to date
+	stage         *stage           // where an output's effects start from
+	deps          []string         // the job and image files the task is made from, for mtime runs
+	Size          string           `json:"-"` //get the size of image from CLI
+	Image         *png.Image       `json:"-"` //pointer to the image object for splitting
+	ChunkStart    int              `json:"-"` // starting y-coordinate of chunk
+	Top           bool             `json:"-"` // indicates if the chunk is the top chunk
+	Bottom        bool             `json:"-"` // indicates if the chunk is the bottom chunk
+	ChunkEnd      int              `json:"-"` // ending y-coordinate of chunk
+
+	png.SaveOptions // output format, depth and encoder settings
 }
 
 func ApplyEffects(task *ImageTask, par bool, startY int, endY int) *ImageTask {
-	e := png.NewEffects()
-	for i, effect := range task.Effects {
-		if i > 0 {
-			task.Image.In = task.Image.Out
-			task.Image.Out = image.NewRGBA64(task.Image.In.Bounds())
+	task.Image.ApplyEffects(task.Effects, par, startY, endY)
+	return task
+}
+
+// runEffects applies the task's effects, split into chunks if the configuration asks
+// for it, and through the result cache if there is one.
+func runEffects(task *ImageTask, config Config) *ImageTask {
+	if task.stage != nil {
+		in := task.stage.output(task.Premultiplied, config)
+		task.Image.In, task.Image.Out, task.Image.Bounds = in, in, in.Bounds()
+		if rest := task.Effects[task.stage.depth:]; len(rest) > 0 {
+			task.Image.Out = png.NewBuffer(in, in.Bounds())
+			runEffects(&ImageTask{Effects: rest, Image: task.Image, Premultiplied: task.Premultiplied}, config)
 		}
-		switch effect {
-		case "S": // Sharpen
-			task.Image.ApplyEffect(e.S, par, startY, endY)
-		case "E": // Edge Detection
-			task.Image.ApplyEffect(e.E, par, startY, endY)
-		case "B": // Blurx
-			task.Image.ApplyEffect(e.B, par, startY, endY)
-		case "G": // Grayscale
-			task.Image.Grayscale(0, 0)
-		default:
-			continue
+		// Saving needs only Out, so the stage's result can go unless Out is it
+		if task.Image.Out != in {
+			task.Image.In = nil
+			task.stage.release()
 		}
+		return task
 	}
-	return task
+	task.Image.Premultiplied = task.Premultiplied
+	if config.cache != nil {
+		e := png.NewEffects()
+		config.cache.Apply(task.Image, task.Effects, func(img *png.Image, pass []png.EffectSpec) {
+			if config.Chunks > 1 {
+				ApplyEffectsChunked(&ImageTask{Effects: pass, Image: img}, config.Chunks)
+			} else {
+				img.ApplyPass(pass, e, false, 0, 0)
+			}
+		})
+		return task
+	}
+	if config.Chunks > 1 {
+		// The chunks write to buffers of their own
+		if task.Image.Out != task.Image.In {
+			png.PutBuffer(task.Image.Out)
+		}
+		return ApplyEffectsChunked(task, config.Chunks)
+	}
+	return ApplyEffects(task, false, 0, 0)
 }
 
 // this function actually processes each image (used in parfiles as well)
-func (task ImageTask) processImage(dirPath string) {
-	location := dirPath + "/" + task.Size + "/" + task.InPath
-	img, err := myPng.Load(location)
+func (task ImageTask) processImage(config Config, inc *incremental) {
+	loaded, err := task.load(config.source(), inc)
 	if err != nil {
 		panic(err)
 	}
-	img.ApplyEffects(task.Effects, false, 0, 0)
-	task.OutPath = task.Size + "_" + task.OutPath
-	outPath := "../data/out/" + task.OutPath
-	_ = img.Save(outPath)
-
-	if err != nil {
-		panic(err)
+	if !loaded {
+		return
+	}
+	for _, frame := range task.split() {
+		runEffects(frame, config)
+		_ = frame.save(config.sink(), inc)
 	}
 }
 
+// ProcessSlice runs the task's effects over its chunk image, leaving the result in Out.
+// Rows near the chunk edges are only exact up to the padding MakeChunk was given.
 func (task ImageTask) ProcessSlice() {
-
 	e := png.NewEffects()
-	var temp *image.RGBA64
-	for i, effect := range task.Effects {
+	for i, pass := range png.Passes(task.Effects) {
 		if i > 0 {
-			task.Image.Out = temp
+			task.Image.In, task.Image.Out = task.Image.Out, task.Image.In
 		}
-		switch effect {
-		case "S": // Sharpen
-			task.Image.ApplyEffect(e.S, true, task.ChunkStart, task.ChunkEnd)
-		case "E": // Edge Detection
-			task.Image.ApplyEffect(e.E, true, task.ChunkStart, task.ChunkEnd)
-		case "B": // Blurx
-			task.Image.ApplyEffect(e.B, true, task.ChunkStart, task.ChunkEnd)
-		case "G": // Grayscale
-			task.Image.Grayscale(task.ChunkStart, task.ChunkEnd)
-		}
-		temp = task.Image.In
-		task.Image.In = task.Image.Out
+		task.Image.ApplyPass(pass, e, false, 0, 0)
 	}
-
 }
 
-// this function reads the effects file and returns details about the images to process
-func getJSON(toChunk bool) []*ImageTask {
-	effectsPathFile := fmt.Sprintf("../data/effects.txt")
-	effectsFile, _ := os.Open(effectsPathFile)
-	reader := json.NewDecoder(effectsFile)
-
-	var images []*ImageTask
-	//toChunk will be false if we are running the sequential scheduler
-
-	for {
-		var imageTask *ImageTask
-		if err := reader.Decode(&imageTask); err != nil {
-			if err == io.EOF {
-				break // End of file reached
-			}
-			log.Fatalf("error decoding JSON: %v", err)
-		}
-		if !toChunk {
-			images = append(images, imageTask)
-		} else {
-
-		}
+// this function reads and validates the job file and returns details about the images to process
+func getTasks(config Config) []*ImageTask {
+	images, err := LoadTasks(config.source())
+	if err != nil {
+		log.Fatalf("error loading job:\n%v", err)
 	}
 	return images
-
 }
 
+// AddChunk copies the rows [ChunkStart, ChunkEnd) the chunk is responsible for into
+// the master image, dropping the padding rows shared with its neighbours.
 func AddChunk(masterImage *png.Image, chunk *ImageTask) {
-	bounds := chunk.Image.Out.Bounds()
-	var startY int
-	//padding correction
-	if chunk.Top {
-		bounds.Max.Y -= 2
-	} else if chunk.Bottom {
-		bounds.Min.Y += 2
-		startY += 2
-	} else {
-		bounds.Min.Y += 2
-		startY += 2
-		bounds.Max.Y -= 2
-	}
-	//cut out the overlapping padding that we added earlier when splitting
-	imgCrop := chunk.Image.Out.SubImage(image.Rect(0, startY, bounds.Max.X, bounds.Max.Y))
-	draw.Draw(masterImage.Out, bounds, imgCrop, image.Point{0, startY}, draw.Src)
-
+	bounds := masterImage.Out.Bounds()
+	bounds.Min.Y, bounds.Max.Y = chunk.ChunkStart, chunk.ChunkEnd
+	png.CopyRect(masterImage.Out, bounds, chunk.Image.Out, bounds.Min)
 }